@@ -2,32 +2,71 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"golang.org/x/sync/errgroup"
+	"net/http"
+	"strings"
 	"time"
 
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/klog"
 
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/constants"
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/controller/secret"
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/controller/webhook"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
 )
 
 func main() {
+	mutateWorkloads := flag.Bool("mutate-workloads", false, "Mutate the Pod templates of the Deployments, StatefulSets, DaemonSets, Jobs and CronJobs rather than only their Pods")
+	mutateKnative := flag.Bool("mutate-knative", false, "Mutate the Pod templates of the Knative Services and Configurations rather than only their Pods")
+	validate := flag.Bool("validate", false, "Register the validating Webhook checking the policies of the Webhook configuration file, to be set only if a policy is not off")
+	// The controller doesn't read the configuration file of the Webhook: --enforce-validation must be
+	// set, along with --validate, whenever a policy of the file is enforce, which the Webhook warns about
+	// at startup
+	enforceValidation := flag.Bool("enforce-validation", false, "Register the validating Webhook with failurePolicy: Fail, requires --validate and must be set if a policy of the Webhook configuration file is enforce so that the Pods are not admitted unchecked")
+	servicePort := flag.Int("service-port", constants.ServicePort, "The port of the Webhook Service registered in the Webhooks")
+	mutatePath := flag.String("mutate-path", constants.MutatePath, "The path of the mutating Webhook, matching the --mutate-path of the Webhook")
+	validatePath := flag.String("validate-path", constants.ValidatePath, "The path of the validating Webhook, matching the --validate-path of the Webhook")
+	logLevel := flag.String("log-level", logging.InfoLevel.String(), "The minimum level of the log lines: debug, info, warn or error, also settable at runtime on the /loglevel of --admin-port")
+	adminPort := flag.Int("admin-port", 0, "The port serving /healthz and /loglevel over plain HTTP, 0 disables it")
+	flag.Parse()
+
+	log := logging.Default()
+	logging.RedirectKlog(log)
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal("Invalid --log-level flag", "error", err)
+	}
+	log.SetLevel(level)
+
+	if *servicePort < 1 || *servicePort > 65535 {
+		log.Fatal("Invalid --service-port flag: not a valid port", "port", *servicePort)
+	}
+	if *enforceValidation && !*validate {
+		log.Fatal("Invalid --enforce-validation flag: it requires --validate")
+	}
+	if !strings.HasPrefix(*mutatePath, "/") || !strings.HasPrefix(*validatePath, "/") {
+		log.Fatal("Invalid --mutate-path or --validate-path flag: the paths must start with /")
+	}
+	if *adminPort < 0 || *adminPort > 65535 {
+		log.Fatal("Invalid --admin-port flag: not a valid port", "port", *adminPort)
+	}
+
 	// TODO: use signals to close this channel
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 
 	config, err := clientcmd.BuildConfigFromFlags("", "")
 	if err != nil {
-		klog.Fatalf("Error building the Kubernetes config: %v", err)
+		log.Fatal("Error building the Kubernetes config", "error", err)
 	}
 
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		klog.Fatalf("Error building the Kubernetes client: %v", err)
+		log.Fatal("Error building the Kubernetes client", "error", err)
 	}
 
 	// Create an informer factory scoped to secretNamespace
@@ -49,14 +88,30 @@ func main() {
 		constants.Namespace,
 		constants.SecretName,
 		informerFactory.Admissionregistration().V1beta1().MutatingWebhookConfigurations(),
-		constants.WebhookName)
+		informerFactory.Admissionregistration().V1beta1().ValidatingWebhookConfigurations(),
+		constants.WebhookName,
+		webhook.ServiceConfig{Port: int32(*servicePort), MutatePath: *mutatePath, ValidatePath: *validatePath},
+		webhook.Options{
+			MutateWorkloads:   *mutateWorkloads,
+			MutateKnative:     *mutateKnative,
+			Validate:          *validate,
+			EnforceValidation: *enforceValidation,
+		})
 
 	informerFactory.Start(stopCh)
 
 	eg, _ := errgroup.WithContext(context.Background())
+	if *adminPort != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})
+		mux.Handle("/loglevel", logging.LevelHandler(log))
+		eg.Go(func() error { return http.ListenAndServe(fmt.Sprintf(":%d", *adminPort), mux) })
+	}
 	eg.Go(func() error { return webhookController.Run(stopCh) })
 	eg.Go(func() error { return secretController.Run(stopCh) })
 	if err = eg.Wait(); err != nil {
-		klog.Fatalf("Error running a controller: %v", err)
+		log.Fatal("Error running a controller", "error", err)
 	}
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authenticationclient "k8s.io/client-go/kubernetes/typed/authentication/v1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+)
+
+// clientAuth selects how the clients of the admission endpoints are authenticated.
+type clientAuth string
+
+const (
+	// noClientAuth accepts any client, it is the default.
+	noClientAuth clientAuth = "none"
+	// certClientAuth requires a client certificate signed by the configured CA, which the API Server
+	// presents when its admission configuration (--admission-control-config-file) has a kubeconfig
+	// for the Webhook.
+	certClientAuth clientAuth = "cert"
+	// tokenClientAuth requires a bearer token issued for the audience of the Webhook, which is
+	// verified with a TokenReview. The allowed clients must be listed, any ServiceAccount of the
+	// cluster having a token the TokenReview authenticates.
+	tokenClientAuth clientAuth = "token"
+)
+
+// tokenReviewTTL is how long the result of a TokenReview is reused for.
+const tokenReviewTTL = time.Minute
+
+// maxCachedTokenReviews bounds the number of cached TokenReviews.
+const maxCachedTokenReviews = 1024
+
+func parseClientAuth(s string) (clientAuth, error) {
+	switch auth := clientAuth(s); auth {
+	case noClientAuth, certClientAuth, tokenClientAuth:
+		return auth, nil
+	}
+	return "", fmt.Errorf("unknown client authentication %q, must be one of %q, %q, %q", s, noClientAuth, certClientAuth, tokenClientAuth)
+}
+
+// loadClientCAs returns the pool of the PEM certificates of the file located at path.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificate found in %q", path)
+	}
+	return pool, nil
+}
+
+// authenticator identifies the clients.
+type authenticator interface {
+	// authenticate returns the name of the client of r, or an error if it isn't authenticated.
+	authenticate(r *http.Request) (string, error)
+}
+
+// certAuthenticator identifies the clients by the common name of their certificate, verified
+// against the client CAs of the TLS configuration.
+type certAuthenticator struct{}
+
+func (certAuthenticator) authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", errors.New("no verified client certificate")
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+// tokenAuthenticator identifies the clients by the user of their bearer token, resolved by a
+// TokenReview. The tokens not issued for audience are rejected. The reviews are cached for
+// tokenReviewTTL.
+type tokenAuthenticator struct {
+	tokenReviews authenticationclient.TokenReviewInterface
+	audience     string
+	now          func() time.Time
+
+	mu      sync.Mutex
+	reviews map[[sha256.Size]byte]cachedTokenReview
+}
+
+type cachedTokenReview struct {
+	user    string
+	err     error
+	expires time.Time
+}
+
+func newTokenAuthenticator(tokenReviews authenticationclient.TokenReviewInterface, audience string) *tokenAuthenticator {
+	return &tokenAuthenticator{
+		tokenReviews: tokenReviews,
+		audience:     audience,
+		now:          time.Now,
+		reviews:      make(map[[sha256.Size]byte]cachedTokenReview),
+	}
+}
+
+func (a *tokenAuthenticator) authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", errors.New("no bearer token")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	// The tokens are only kept hashed
+	key := sha256.Sum256([]byte(token))
+
+	now := a.now()
+	a.mu.Lock()
+	cached, ok := a.reviews[key]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.user, cached.err
+	}
+
+	user, err := a.review(token)
+	if err != nil && !errors.Is(err, errTokenNotAuthenticated) {
+		// Failing to review the token says nothing about it
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.reviews) >= maxCachedTokenReviews {
+		a.reviews = make(map[[sha256.Size]byte]cachedTokenReview)
+	}
+	a.reviews[key] = cachedTokenReview{user: user, err: err, expires: now.Add(tokenReviewTTL)}
+	return user, err
+}
+
+var errTokenNotAuthenticated = errors.New("the token is not authenticated")
+
+// review returns the user of token, resolved by a TokenReview.
+func (a *tokenAuthenticator) review(token string) (string, error) {
+	review, err := a.tokenReviews.Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{a.audience}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to review the token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return "", fmt.Errorf("%w: %s", errTokenNotAuthenticated, review.Status.Error)
+		}
+		return "", errTokenNotAuthenticated
+	}
+	// The authenticators ignoring the audiences don't return them
+	for _, audience := range review.Status.Audiences {
+		if audience == a.audience {
+			return review.Status.User.Username, nil
+		}
+	}
+	return "", fmt.Errorf("%w: not issued for the audience %q", errTokenNotAuthenticated, a.audience)
+}
+
+// withAuthentication returns handler, rejecting the requests not authenticated by auth or whose
+// client isn't in allowed, if set. The rejections are counted in m under the name of the Webhook.
+func withAuthentication(webhook string, handler http.Handler, auth authenticator, allowed map[string]bool, m *admissionMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := auth.authenticate(r)
+		if err != nil {
+			m.unauthenticated.Inc(webhook, "unauthenticated")
+			logging.Default().Warn("Rejecting the unauthenticated request", "webhook", webhook, "remoteAddr", r.RemoteAddr, "error", err)
+			http.Error(w, "unauthenticated client", http.StatusUnauthorized)
+			return
+		}
+		if len(allowed) > 0 && !allowed[client] {
+			m.unauthenticated.Inc(webhook, "not_allowed")
+			logging.Default().Warn("Rejecting the request of a client not allowed", "webhook", webhook, "remoteAddr", r.RemoteAddr, "client", client)
+			http.Error(w, fmt.Sprintf("client %q not allowed", client), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/metrics"
+)
+
+func TestParseClientAuth(t *testing.T) {
+	for _, s := range []string{"none", "cert", "token"} {
+		if _, err := parseClientAuth(s); err != nil {
+			t.Errorf("Failed to parse %q: %v", s, err)
+		}
+	}
+	if _, err := parseClientAuth("password"); err == nil {
+		t.Errorf("An unknown authentication should be rejected")
+	}
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	r := httptest.NewRequest("POST", "/mutate", nil)
+	if _, err := (certAuthenticator{}).authenticate(r); err == nil {
+		t.Fatalf("A request without certificate should not be authenticated")
+	}
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "kube-apiserver"}},
+	}}}
+	client, err := (certAuthenticator{}).authenticate(r)
+	if err != nil || client != "kube-apiserver" {
+		t.Fatalf("Unexpected client: %q, %v", client, err)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	reviews := 0
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "valid":
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1.UserInfo{Username: "system:kube-apiserver"},
+				Audiences:     review.Spec.Audiences,
+			}
+		case "other-audience":
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1.UserInfo{Username: "system:serviceaccount:default:default"},
+				Audiences:     []string{"https://kubernetes.default.svc"},
+			}
+		}
+		return true, review, nil
+	})
+	a := newTokenAuthenticator(client.AuthenticationV1().TokenReviews(), "node-ip-webhook")
+
+	tests := []struct {
+		name   string
+		header string
+		client string
+		valid  bool
+	}{{
+		name: "no token",
+	}, {
+		name:   "invalid token",
+		header: "Bearer invalid",
+	}, {
+		name:   "token of another audience",
+		header: "Bearer other-audience",
+	}, {
+		name:   "valid token",
+		header: "Bearer valid",
+		client: "system:kube-apiserver",
+		valid:  true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/mutate", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			client, err := a.authenticate(r)
+			if test.valid != (err == nil) || client != test.client {
+				t.Fatalf("Unexpected authentication: %q, %v", client, err)
+			}
+		})
+	}
+
+	// The reviews are cached
+	r := httptest.NewRequest("POST", "/mutate", nil)
+	r.Header.Set("Authorization", "Bearer valid")
+	if _, err := a.authenticate(r); err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+	if reviews != 3 {
+		t.Fatalf("Unexpected number of TokenReviews: got %d, want 3", reviews)
+	}
+}
+
+func TestWithAuthentication(t *testing.T) {
+	registry := metrics.NewRegistry()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := withAuthentication("mutate", ok, certAuthenticator{}, map[string]bool{"kube-apiserver": true}, newAdmissionMetrics(registry))
+
+	tests := []struct {
+		name     string
+		client   string
+		httpCode int
+	}{{
+		name:     "unauthenticated",
+		httpCode: http.StatusUnauthorized,
+	}, {
+		name:     "not allowed",
+		client:   "someone",
+		httpCode: http.StatusForbidden,
+	}, {
+		name:     "allowed",
+		client:   "kube-apiserver",
+		httpCode: http.StatusOK,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/mutate", nil)
+			if test.client != "" {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+					{Subject: pkix.Name{CommonName: test.client}},
+				}}}
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.httpCode {
+				t.Fatalf("Unexpected HTTP status code: got %d, want %d", w.Code, test.httpCode)
+			}
+		})
+	}
+
+	var b strings.Builder
+	if err := registry.Write(&b); err != nil {
+		t.Fatalf("Failed to write the metrics: %v", err)
+	}
+	for _, expected := range []string{
+		`admission_unauthenticated_requests_total{webhook="mutate",reason="not_allowed"} 1`,
+		`admission_unauthenticated_requests_total{webhook="mutate",reason="unauthenticated"} 1`,
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("Missing %q in:\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestWithTokenAuthenticationRejectsTheClientsNotAllowed(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status = authenticationv1.TokenReviewStatus{
+			Authenticated: true,
+			User:          authenticationv1.UserInfo{Username: "system:serviceaccount:" + review.Spec.Token},
+			Audiences:     review.Spec.Audiences,
+		}
+		return true, review, nil
+	})
+	a := newTokenAuthenticator(client.AuthenticationV1().TokenReviews(), "node-ip-webhook")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	allowed := map[string]bool{"system:serviceaccount:kube-system:kube-apiserver": true}
+	handler := withAuthentication("mutate", ok, a, allowed, newAdmissionMetrics(metrics.NewRegistry()))
+
+	for token, httpCode := range map[string]int{
+		"default:some-pod":           http.StatusForbidden,
+		"kube-system:kube-apiserver": http.StatusOK,
+	} {
+		r := httptest.NewRequest("POST", "/mutate", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != httpCode {
+			t.Errorf("Unexpected HTTP status code for %q: got %d, want %d", token, w.Code, httpCode)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker. It trips when threshold failures happen within window, then stays
+// open for cooldown. Once cooled down, it lets a single request through: a success closes it, a
+// failure trips it again.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu sync.Mutex
+	// failures are the times of the failures within window, while closed.
+	failures []time.Time
+	// openUntil is the end of the cooldown, it is zero while closed.
+	openUntil time.Time
+	// probing is true while the request let through after the cooldown is in flight.
+	probing bool
+}
+
+func newBreaker(threshold int, window, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, window: window, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns true if the request can be attempted, false if the breaker is open.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful request, closing the breaker.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.probing {
+		b.probing = false
+		b.openUntil = time.Time{}
+	}
+}
+
+// failure records a failed request and returns true if it trips the breaker.
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.probing {
+		b.probing = false
+		b.openUntil = now.Add(b.cooldown)
+		return true
+	}
+	if !b.openUntil.IsZero() {
+		// Requests attempted before the breaker tripped
+		return false
+	}
+
+	recent := b.failures[:0]
+	for _, t := range b.failures {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	b.failures = append(recent, now)
+	if len(b.failures) < b.threshold {
+		return false
+	}
+	b.failures = nil
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(3, time.Minute, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	// Failures spread over more than the window don't trip it
+	for i := 0; i < 4; i++ {
+		if b.failure() {
+			t.Fatalf("Failure %d shouldn't trip the breaker", i)
+		}
+		now = now.Add(40 * time.Second)
+	}
+	if !b.allow() {
+		t.Fatalf("The breaker should be closed")
+	}
+
+	b.failure()
+	now = now.Add(time.Second)
+	if !b.failure() {
+		t.Fatalf("The third failure within the window should trip the breaker")
+	}
+	if b.allow() {
+		t.Fatalf("The breaker should be open")
+	}
+
+	// A failed probe trips it again
+	now = now.Add(30 * time.Second)
+	if !b.allow() {
+		t.Fatalf("A probe should be let through after the cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("A single probe should be let through at a time")
+	}
+	if !b.failure() {
+		t.Fatalf("A failed probe should trip the breaker")
+	}
+	if b.allow() {
+		t.Fatalf("The breaker should be open")
+	}
+
+	// A successful probe closes it
+	now = now.Add(30 * time.Second)
+	if !b.allow() {
+		t.Fatalf("A probe should be let through after the cooldown")
+	}
+	b.success()
+	if !b.allow() || !b.allow() {
+		t.Fatalf("The breaker should be closed")
+	}
+	if b.failure() {
+		t.Fatalf("The failures counted before tripping should be forgotten")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+// config is the content of the configuration file of the Webhook.
+type config struct {
+	// Config configures the Mutators of the mutating Webhook.
+	mutation.Config
+	// Validation sets the action of the policies checked by the validating Webhook.
+	Validation validationConfig `json:"validation"`
+	// TLS is the TLS policy of the server, overridden by the --tls-* and --http2 flags.
+	TLS tlsPolicy `json:"tls"`
+}
+
+// loadConfig reads and validates the configuration file located at path.
+// An empty path yields the default configuration. The Config of the Mutators is validated when
+// mutation.NewBuiltinMutators builds them.
+func loadConfig(path string) (*config, error) {
+	c := &config{}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the configuration file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("failed to decode the configuration file %q: %w", path, err)
+	}
+	if err := c.Validation.validate(); err != nil {
+		return nil, fmt.Errorf("invalid validation configuration: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected *config
+		valid    bool
+	}{{
+		name: "valid",
+		content: `
+sidecars:
+  names: ["vault-agent"]
+  images: ["^example\\.com/sidecars/"]
+`,
+		expected: &config{Config: mutation.Config{Sidecars: mutation.SidecarConfig{Names: []string{"vault-agent"}, Images: []string{`^example\.com/sidecars/`}}}},
+		valid:    true,
+	}, {
+		name:     "empty",
+		content:  "",
+		expected: &config{},
+		valid:    true,
+	}, {
+		name:    "unknown field",
+		content: "sidecar:\n  names: [\"vault-agent\"]\n",
+	}, {
+		name:    "invalid image pattern",
+		content: "sidecars:\n  images: [\"(\"]\n",
+	}, {
+		name: "agent sidecar",
+		content: `
+agentSidecar:
+  selectors:
+  - tolerationKey: virtual-kubelet.io/provider
+  image: datadog/agent:7
+  apiKeySecret:
+    name: datadog
+    key: api-key
+`,
+		expected: &config{Config: mutation.Config{AgentSidecar: mutation.AgentSidecarConfig{
+			Selectors:    []mutation.NodePoolSelector{{TolerationKey: "virtual-kubelet.io/provider"}},
+			Image:        "datadog/agent:7",
+			APIKeySecret: corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "datadog"}, Key: "api-key"},
+		}}},
+		valid: true,
+	}, {
+		name:     "agent service",
+		content:  "agentService:\n  name: agent\n  namespace: monitoring\n",
+		expected: &config{Config: mutation.Config{AgentService: mutation.AgentServiceConfig{Name: "agent", Namespace: "monitoring"}}},
+		valid:    true,
+	}, {
+		name:    "invalid agent service",
+		content: "agentService:\n  name: agent.monitoring\n",
+	}, {
+		name:    "invalid autodiscovery template",
+		content: "autodiscovery:\n  annotations:\n    logs: \"{{.Labels\"\n",
+	}, {
+		name:    "invalid autodiscovery suffix",
+		content: "autodiscovery:\n  annotations:\n    \"logs/source\": source\n",
+	}, {
+		name:     "env",
+		content:  "env:\n- name: DD_TAGS\n  value: \"team:{{.Labels.team}}\"\n",
+		expected: &config{Config: mutation.Config{Env: []mutation.EnvTemplateConfig{{Name: "DD_TAGS", Value: "team:{{.Labels.team}}"}}}},
+		valid:    true,
+	}, {
+		name:    "env with an unknown field",
+		content: "env:\n- name: DD_TAGS\n  value: \"{{.Pod.Spec}}\"\n",
+	}, {
+		name:    "env with an invalid name",
+		content: "env:\n- name: \"\"\n  value: tags\n",
+	}, {
+		name:     "validation",
+		content:  "validation:\n  literalAgentHost: enforce\n  hostNetwork: warn\n",
+		expected: &config{Validation: validationConfig{LiteralAgentHost: enforceAction, HostNetwork: warnAction}},
+		valid:    true,
+	}, {
+		name:    "invalid validation action",
+		content: "validation:\n  hostNetwork: reject\n",
+	}, {
+		name:     "tls",
+		content:  "tls:\n  minVersion: \"1.3\"\n  curvePreferences: [X25519]\n  http2: false\n",
+		expected: &config{TLS: tlsPolicy{MinVersion: "1.3", CurvePreferences: []string{"X25519"}, HTTP2: new(bool)}},
+		valid:    true,
+	}, {
+		name:    "agent sidecar without image",
+		content: "agentSidecar:\n  selectors:\n  - tolerationKey: virtual-kubelet.io/provider\n",
+	}, {
+		name:    "agent sidecar with an empty selector",
+		content: "agentSidecar:\n  selectors:\n  - {}\n  image: datadog/agent:7\n  apiKeySecret: {name: datadog, key: api-key}\n",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := loadConfig(writeConfig(t, test.content))
+			if err == nil {
+				// As in main, the Config of the Mutators is validated by building them
+				_, err = mutation.NewBuiltinMutators(&c.Config, nil, mutation.HostIPMode, nil)
+			}
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("The configuration should be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load the configuration: %v", err)
+			}
+			if !reflect.DeepEqual(c, test.expected) {
+				t.Fatalf("Unexpected configuration: got %+v, want %+v", c, test.expected)
+			}
+		})
+	}
+}
+
+// writeConfig writes content to a temporary file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create the configuration file: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("Failed to write the configuration file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Failed to close the configuration file: %v", err)
+	}
+	return f.Name()
+}
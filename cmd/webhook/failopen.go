@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+// failOpenAuditAnnotation records why an object was admitted without being mutated.
+const failOpenAuditAnnotation = "fail-open"
+
+// failOpen admits the objects without mutating them when the mutation fails, rather than
+// preventing their creation. The denials, e.g. because of an invalid annotation, are not failures.
+type failOpen struct {
+	webhook string
+	admit   admitFunc
+	// breaker skips the mutation altogether while it fails repeatedly, it is optional.
+	breaker *breaker
+	metrics *admissionMetrics
+}
+
+// admitOrPass returns the result of admit, or admits the object unmodified if it fails.
+func (f *failOpen) admitOrPass(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+	dryRun := strconv.FormatBool(mutation.IsDryRun(req))
+	if f.breaker != nil && !f.breaker.allow() {
+		f.metrics.failOpen.Inc(f.webhook, "breaker_open", dryRun)
+		return passThrough("the circuit breaker is open"), nil
+	}
+
+	resp, err := f.admit(req)
+	if err == nil || mutation.IsDenied(err) {
+		if f.breaker != nil {
+			f.breaker.success()
+		}
+		return resp, err
+	}
+
+	log := logging.ForAdmission(req).With("webhook", f.webhook)
+	log.Error("Failed to mutate the object, admitting it without mutating it", "error", err)
+	f.metrics.failOpen.Inc(f.webhook, "error", dryRun)
+	if f.breaker != nil && f.breaker.failure() {
+		log.Warn("The circuit breaker tripped, admitting the objects without mutating them",
+			"failures", f.breaker.threshold, "window", f.breaker.window, "cooldown", f.breaker.cooldown)
+		f.metrics.breakerTrips.Inc(f.webhook)
+	}
+	return passThrough(err.Error()), nil
+}
+
+// passThrough returns the response admitting the object unmodified for the provided reason.
+func passThrough(reason string) *admiv1beta1.AdmissionResponse {
+	return &admiv1beta1.AdmissionResponse{
+		Allowed:          true,
+		AuditAnnotations: map[string]string{failOpenAuditAnnotation: reason},
+	}
+}
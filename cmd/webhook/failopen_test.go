@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/metrics"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+func TestFailOpen(t *testing.T) {
+	mutated := &admiv1beta1.AdmissionResponse{Allowed: true, Patch: []byte(`[]`)}
+	tests := []struct {
+		name     string
+		err      error
+		expected *admiv1beta1.AdmissionResponse
+		denied   bool
+	}{{
+		name:     "success",
+		expected: mutated,
+	}, {
+		name:     "failure",
+		err:      errors.New("boom"),
+		expected: &admiv1beta1.AdmissionResponse{Allowed: true, AuditAnnotations: map[string]string{failOpenAuditAnnotation: "boom"}},
+	}, {
+		name:   "denial",
+		err:    denial(t),
+		denied: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &failOpen{
+				webhook: "mutate",
+				admit: func(*admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+					if test.err != nil {
+						return nil, test.err
+					}
+					return mutated, nil
+				},
+				metrics: newAdmissionMetrics(metrics.NewRegistry()),
+			}
+			resp, err := f.admitOrPass(newAdmissionRequest(t, newAnnotatedPod(nil)))
+			if test.denied {
+				if !mutation.IsDenied(err) {
+					t.Fatalf("The denial should be returned, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(resp, test.expected) {
+				t.Fatalf("Unexpected response: got %+v, want %+v", resp, test.expected)
+			}
+		})
+	}
+}
+
+func TestFailOpenBreaker(t *testing.T) {
+	calls := 0
+	f := &failOpen{
+		webhook: "mutate",
+		admit: func(*admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+			calls++
+			return nil, errors.New("boom")
+		},
+		breaker: newBreaker(2, time.Minute, time.Minute),
+		metrics: newAdmissionMetrics(metrics.NewRegistry()),
+	}
+	req := newAdmissionRequest(t, newAnnotatedPod(nil))
+	for i := 0; i < 5; i++ {
+		resp, err := f.admitOrPass(req)
+		if err != nil || !resp.Allowed {
+			t.Fatalf("The object should be admitted: %v, %v", resp, err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("The mutation should be skipped once the breaker tripped, got %d calls", calls)
+	}
+}
+
+// denial returns the error of the Pipeline for a Pod with an invalid annotation.
+func denial(t *testing.T) error {
+	mutators, err := mutation.NewBuiltinMutators(&mutation.Config{}, nil, mutation.HostIPMode, nil)
+	if err != nil {
+		t.Fatalf("Failed to create the Mutators: %v", err)
+	}
+	pod := newAnnotatedPod(map[string]string{mutation.ModeAnnotation: "carrier-pigeon"})
+	_, err = mutation.NewPipeline(mutators...).Mutate(newAdmissionRequest(t, pod))
+	return err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+const (
+	jsonContentType = `application/json`
+)
+
+var (
+	deserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+)
+
+// admitFunc admits the object of an admission request. The returned errors reject it.
+type admitFunc func(*admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error)
+
+// panicError is returned by the admitFuncs wrapped by recoverPanics when they panic.
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// recoverPanics returns admit, with its panics turned into errors so that they yield a response,
+// and possibly fail open, rather than aborting the connection.
+func recoverPanics(admit admitFunc) admitFunc {
+	return func(req *admiv1beta1.AdmissionRequest) (resp *admiv1beta1.AdmissionResponse, err error) {
+		defer func() {
+			if value := recover(); value != nil {
+				logging.ForAdmission(req).Error("Recovered from a panic while admitting the object", "panic", fmt.Sprint(value), "stack", string(debug.Stack()))
+				resp, err = nil, &panicError{value: value}
+			}
+		}()
+		return admit(req)
+	}
+}
+
+// newStatus returns the Status of a failed admission, detailing the admitted object if req is set.
+func newStatus(req *admiv1beta1.AdmissionRequest, code int32, reason metav1.StatusReason, message string) *metav1.Status {
+	status := &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: message,
+		Reason:  reason,
+		Code:    code,
+	}
+	if req != nil {
+		status.Details = &metav1.StatusDetails{
+			Name:  req.Name,
+			Group: req.Kind.Group,
+			Kind:  req.Kind.Kind,
+		}
+	}
+	return status
+}
+
+// errorStatus returns the Status of the admission of req rejected because of err.
+func errorStatus(req *admiv1beta1.AdmissionRequest, err error) *metav1.Status {
+	if mutation.IsDenied(err) {
+		status := newStatus(req, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error())
+		status.Details.Causes = []metav1.StatusCause{{Type: metav1.CauseTypeFieldValueInvalid, Message: err.Error()}}
+		return status
+	}
+	var p *panicError
+	if errors.As(err, &p) {
+		// The details are in the logs of the Webhook
+		return newStatus(req, http.StatusInternalServerError, metav1.StatusReasonInternalError, "internal error of the Webhook")
+	}
+	return newStatus(req, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+}
+
+// handlerLimits bounds the resources used by the admission handlers.
+type handlerLimits struct {
+	// maxBodyBytes is the maximum size of an AdmissionReview.
+	maxBodyBytes int64
+	// inFlight holds a token per request being admitted, its capacity is the maximum number of
+	// concurrent requests.
+	inFlight chan struct{}
+}
+
+func newHandlerLimits(maxBodyBytes int64, maxInFlight int) *handlerLimits {
+	return &handlerLimits{maxBodyBytes: maxBodyBytes, inFlight: make(chan struct{}, maxInFlight)}
+}
+
+// admissionHandler returns the handler decoding the AdmissionReviews and responding with the
+// result of admit. The admissions are recorded in m under the name of the Webhook.
+func admissionHandler(webhook string, admit admitFunc, m *admissionMetrics, limits *handlerLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// The request isn't identified until its AdmissionReview is decoded
+		log := logging.Default().With("webhook", webhook, "remoteAddr", r.RemoteAddr)
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			log.Warn("Invalid method, only POST requests are allowed", "method", r.Method)
+			return
+		}
+
+		// Shed the load rather than queuing requests the API Server would give up on. It retries
+		// the requests rejected with a Retry-After header.
+		select {
+		case limits.inFlight <- struct{}{}:
+			defer func() { <-limits.inFlight }()
+		default:
+			m.shed.Inc(webhook)
+			log.Warn("Too many in-flight requests, rejecting the request", "limit", cap(limits.inFlight))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, fmt.Sprintf("too many in-flight admission requests, the limit is %d", cap(limits.inFlight)), http.StatusTooManyRequests)
+			return
+		}
+
+		defer r.Body.Close()
+		// The extra byte tells a body of the maximum size from a larger one
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, limits.maxBodyBytes+1))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Warn("Could not read the request body", "error", err)
+			return
+		}
+		if int64(len(body)) > limits.maxBodyBytes {
+			log.Warn("The request body is too large", "limit", limits.maxBodyBytes)
+			http.Error(w, fmt.Sprintf("the AdmissionReview exceeds %d bytes", limits.maxBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if contentType := r.Header.Get("Content-Type"); !isJSON(contentType) {
+			log.Warn("Unsupported content type, only "+jsonContentType+" is supported", "contentType", contentType)
+			writeMalformed(w, body, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported content type %s, only %s is supported", contentType, jsonContentType))
+			return
+		}
+
+		var admissionReviewReq admiv1beta1.AdmissionReview
+		if _, _, err := deserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+			log.Warn("Could not deserialize the AdmissionReview", "error", err)
+			writeMalformed(w, body, http.StatusBadRequest, fmt.Sprintf("could not deserialize request: %v", err))
+			return
+		} else if admissionReviewReq.Request == nil {
+			log.Warn("Malformed AdmissionReview: the request is nil")
+			writeMalformed(w, body, http.StatusBadRequest, "malformed admission review: request is nil")
+			return
+		}
+
+		req := admissionReviewReq.Request
+		log = logging.ForAdmission(req).With("webhook", webhook)
+		resp, err := recoverPanics(admit)(req)
+		duration := time.Since(start)
+		m.observe(webhook, req, resp, err, duration)
+		if err != nil {
+			resp = &admiv1beta1.AdmissionResponse{
+				Result:  errorStatus(req, err),
+				Allowed: false,
+			}
+			if mutation.IsDenied(err) {
+				log.Info("Denied the object", "reason", err, "duration", duration)
+			} else {
+				log.Error("Failed to admit the object, rejecting it", "error", err, "duration", duration)
+			}
+		} else {
+			log.Debug("Admitted the object", "allowed", resp.Allowed, "patched", len(resp.Patch) > 0, "duration", duration)
+		}
+		resp.UID = req.UID
+		writeReview(w, http.StatusOK, resp)
+	}
+}
+
+// isJSON returns true if contentType is the JSON media type, with any parameter.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == jsonContentType
+}
+
+// writeMalformed responds to a malformed AdmissionReview. The response carries the UID of the
+// request, if it can be extracted, so that the API Server reports the error: it ignores the
+// response otherwise, hence the HTTP status code.
+func writeMalformed(w http.ResponseWriter, body []byte, code int32, message string) {
+	resp := &admiv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result:  newStatus(nil, code, metav1.StatusReasonBadRequest, message),
+	}
+	if code == http.StatusUnsupportedMediaType {
+		resp.Result.Reason = metav1.StatusReasonUnsupportedMediaType
+	}
+	resp.UID = extractUID(body)
+	httpCode := int(code)
+	if resp.UID != "" {
+		httpCode = http.StatusOK
+	}
+	writeReview(w, httpCode, resp)
+}
+
+// extractUID returns the UID of the AdmissionReview encoded in body, or an empty string.
+func extractUID(body []byte) types.UID {
+	var review struct {
+		Request *struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		return ""
+	}
+	return review.Request.UID
+}
+
+// writeReview writes the AdmissionReview carrying resp.
+func writeReview(w http.ResponseWriter, code int, resp *admiv1beta1.AdmissionResponse) {
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(&admiv1beta1.AdmissionReview{Response: resp}); err != nil {
+		logging.Default().Error("Failed to encode the AdmissionReview", "error", err)
+	}
+}
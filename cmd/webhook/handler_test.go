@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/metrics"
+)
+
+func TestAdmissionHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		admit  admitFunc
+		code   int32
+		reason metav1.StatusReason
+	}{{
+		name: "panic",
+		admit: func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+			var resp *admiv1beta1.AdmissionResponse
+			resp.Allowed = true
+			return resp, nil
+		},
+		code:   http.StatusInternalServerError,
+		reason: metav1.StatusReasonInternalError,
+	}, {
+		name: "error",
+		admit: func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+			return nil, errors.New("boom")
+		},
+		code:   http.StatusInternalServerError,
+		reason: metav1.StatusReasonInternalError,
+	}, {
+		name: "denial",
+		admit: func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+			return nil, denial(t)
+		},
+		code:   http.StatusUnprocessableEntity,
+		reason: metav1.StatusReasonInvalid,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := admissionHandler("mutate", test.admit, newAdmissionMetrics(metrics.NewRegistry()), newTestHandlerLimits())
+			w := httptest.NewRecorder()
+			handler(w, newReviewRequest(t, newAdmissionRequest(t, newAnnotatedPod(nil)), jsonContentType))
+
+			resp := decodeReviewResponse(t, w, http.StatusOK)
+			if resp.Allowed || resp.UID != "uid" {
+				t.Fatalf("The request should be denied with its UID: %+v", resp)
+			}
+			if resp.Result.Code != test.code || resp.Result.Reason != test.reason || resp.Result.Details.Kind != "Pod" {
+				t.Fatalf("Unexpected status: %+v", resp.Result)
+			}
+		})
+	}
+}
+
+func TestAdmissionHandlerLogsTheRequest(t *testing.T) {
+	var b bytes.Buffer
+	previous := logging.Default()
+	logging.SetDefault(logging.New(&b, logging.InfoLevel))
+	t.Cleanup(func() { logging.SetDefault(previous) })
+
+	handler := admissionHandler("mutate", func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+		return nil, errors.New("boom")
+	}, newAdmissionMetrics(metrics.NewRegistry()), newTestHandlerLimits())
+	pod := newAnnotatedPod(nil)
+	pod.Name, pod.GenerateName = "", "api-"
+	req := newAdmissionRequest(t, pod)
+	req.UserInfo.Username = "alice"
+	handler(httptest.NewRecorder(), newReviewRequest(t, req, jsonContentType))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("Failed to decode the log line %q: %v", b.String(), err)
+	}
+	for key, value := range map[string]interface{}{
+		"level":        "error",
+		"webhook":      "mutate",
+		"uid":          "uid",
+		"namespace":    req.Namespace,
+		"operation":    "CREATE",
+		"user":         "alice",
+		"generateName": "api-",
+		"error":        "boom",
+	} {
+		if line[key] != value {
+			t.Errorf("Unexpected %s: got %v, want %v", key, line[key], value)
+		}
+	}
+}
+
+func TestAdmissionHandlerFailsOpenOnPanic(t *testing.T) {
+	f := &failOpen{
+		webhook: "mutate",
+		admit: recoverPanics(func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+			panic("boom")
+		}),
+		metrics: newAdmissionMetrics(metrics.NewRegistry()),
+	}
+	resp, err := f.admitOrPass(newAdmissionRequest(t, newAnnotatedPod(nil)))
+	if err != nil || !resp.Allowed {
+		t.Fatalf("The panic should fail open: %+v, %v", resp, err)
+	}
+}
+
+func TestAdmissionHandlerMalformedRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		httpCode    int
+		uid         types.UID
+		code        int32
+	}{{
+		name:        "invalid review with a uid",
+		body:        `{"kind": "AdmissionReview", "apiVersion": "admission.k8s.io/v1beta1", "request": {"uid": "uid", "operation": 42}}`,
+		contentType: jsonContentType,
+		httpCode:    http.StatusOK,
+		uid:         "uid",
+		code:        http.StatusBadRequest,
+	}, {
+		name:        "no request",
+		body:        `{"kind": "AdmissionReview", "apiVersion": "admission.k8s.io/v1beta1"}`,
+		contentType: jsonContentType,
+		httpCode:    http.StatusBadRequest,
+		code:        http.StatusBadRequest,
+	}, {
+		name:        "content type",
+		body:        `{"kind": "AdmissionReview", "apiVersion": "admission.k8s.io/v1beta1", "request": {"uid": "uid"}}`,
+		contentType: "text/plain",
+		httpCode:    http.StatusOK,
+		uid:         "uid",
+		code:        http.StatusUnsupportedMediaType,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := admissionHandler("mutate", nil, newAdmissionMetrics(metrics.NewRegistry()), newTestHandlerLimits())
+			r := httptest.NewRequest("POST", "/mutate", bytes.NewReader([]byte(test.body)))
+			r.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			resp := decodeReviewResponse(t, w, test.httpCode)
+			if resp.Allowed || resp.UID != test.uid || resp.Result.Code != test.code {
+				t.Fatalf("Unexpected response: %+v, %+v", resp, resp.Result)
+			}
+		})
+	}
+}
+
+func newReviewRequest(t *testing.T, req *admiv1beta1.AdmissionRequest, contentType string) *http.Request {
+	body, err := json.Marshal(&admiv1beta1.AdmissionReview{Request: req})
+	if err != nil {
+		t.Fatalf("Failed to encode the AdmissionReview: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/mutate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func decodeReviewResponse(t *testing.T, w *httptest.ResponseRecorder, code int) *admiv1beta1.AdmissionResponse {
+	if w.Code != code {
+		t.Fatalf("Unexpected HTTP status code: got %d, want %d", w.Code, code)
+	}
+	var review admiv1beta1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	if review.Response == nil {
+		t.Fatalf("The AdmissionReview has no response: %s", w.Body.String())
+	}
+	return review.Response
+}
+
+func TestAdmissionHandlerLimits(t *testing.T) {
+	allow := func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+		return &admiv1beta1.AdmissionResponse{Allowed: true}, nil
+	}
+	tests := []struct {
+		name        string
+		limits      *handlerLimits
+		contentType string
+		httpCode    int
+	}{{
+		name:        "content type parameters",
+		limits:      newTestHandlerLimits(),
+		contentType: "application/json; charset=utf-8",
+		httpCode:    http.StatusOK,
+	}, {
+		name:        "body too large",
+		limits:      newHandlerLimits(64, 1),
+		contentType: jsonContentType,
+		httpCode:    http.StatusRequestEntityTooLarge,
+	}, {
+		name: "too many in-flight requests",
+		limits: func() *handlerLimits {
+			limits := newTestHandlerLimits()
+			for i := 0; i < cap(limits.inFlight); i++ {
+				limits.inFlight <- struct{}{}
+			}
+			return limits
+		}(),
+		contentType: jsonContentType,
+		httpCode:    http.StatusTooManyRequests,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newAdmissionMetrics(metrics.NewRegistry())
+			handler := admissionHandler("mutate", allow, m, test.limits)
+			w := httptest.NewRecorder()
+			handler(w, newReviewRequest(t, newAdmissionRequest(t, newAnnotatedPod(nil)), test.contentType))
+			if w.Code != test.httpCode {
+				t.Fatalf("Unexpected HTTP status code: got %d, want %d: %s", w.Code, test.httpCode, w.Body.String())
+			}
+			if test.httpCode == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Fatalf("The shed requests should be retried")
+			}
+		})
+	}
+}
+
+func newTestHandlerLimits() *handlerLimits {
+	return newHandlerLimits(1<<20, 2)
+}
@@ -2,176 +2,244 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	admiv1beta1 "k8s.io/api/admission/v1beta1"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/klog"
-	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/certificate"
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/constants"
-	"gomodules.xyz/jsonpatch/v3"
-)
-
-const (
-	jsonContentType = `application/json`
-	envVarName      = "DD_AGENT_HOST"
-)
-
-var (
-	deserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/metrics"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
 )
 
 func main() {
-	config, err := clientcmd.BuildConfigFromFlags("", "")
+	defaultMode := flag.String("mode", string(mutation.HostIPMode), "The injection mode used when neither the Pod nor its Namespace is annotated with "+mutation.ModeAnnotation)
+	defaultProfiles := flag.String("profiles", "", "The comma-separated profiles injected when neither the Pod nor its Namespace is annotated with "+mutation.ProfilesAnnotation)
+	configPath := flag.String("config", "", "The path of the configuration file")
+	failOpenEnabled := flag.Bool("fail-open", false, "Admit the objects without mutating them when the mutation fails, rather than rejecting them")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "With --fail-open, the number of failures within --breaker-window skipping the mutation for --breaker-cooldown, 0 disables the circuit breaker")
+	breakerWindow := flag.Duration("breaker-window", time.Minute, "The window in which the failures are counted by the circuit breaker")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "The time the mutation is skipped for once the circuit breaker tripped")
+	maxRequestBytes := flag.Int64("max-request-bytes", 8<<20, "The maximum size of an AdmissionReview, larger requests are rejected")
+	maxInFlight := flag.Int("max-in-flight", 64, "The maximum number of requests admitted concurrently, the others are rejected for the API Server to retry them")
+	clientAuthFlag := flag.String("client-auth", string(noClientAuth), "How the clients of the admission endpoints are authenticated: none, cert (client certificate signed by --client-ca-file) or token (bearer token verified with a TokenReview)")
+	clientCAFile := flag.String("client-ca-file", "", "With --client-auth=cert, the path of the PEM bundle of the CAs signing the client certificate of the API Server")
+	allowedClients := flag.String("allowed-clients", "", "The comma-separated names of the clients allowed, once authenticated: the common names of the certificates or the users of the tokens. Required by --client-auth=token, any authenticated client is allowed if empty with --client-auth=cert")
+	tokenAudience := flag.String("token-audience", constants.WebhookName, "With --client-auth=token, the audience the tokens must be issued for")
+	tlsMinVersion := flag.String("tls-min-version", defaultTLSMinVersion, "The minimum version of TLS: 1.0, 1.1, 1.2 or 1.3")
+	tlsCipherSuites := flag.String("tls-cipher-suites", "", "The comma-separated cipher suites of TLS 1.0 to 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. The secure suites of Go are used if empty")
+	tlsCurvePreferences := flag.String("tls-curve-preferences", "", "The comma-separated elliptic curves, by order of preference: X25519, P256, P384 or P521. The default curves of Go are used if empty")
+	http2 := flag.Bool("http2", true, "Serve HTTP/2 in addition to HTTP/1.1")
+	port := flag.Int("port", 8443, "The port of the admission endpoints, served over TLS")
+	metricsPort := flag.Int("metrics-port", 0, "The port serving /metrics and /healthz over plain HTTP, 0 serves them on --port instead")
+	mutatePath := flag.String("mutate-path", constants.MutatePath, "The path of the mutating Webhook, matching the --mutate-path of the controller")
+	validatePath := flag.String("validate-path", constants.ValidatePath, "The path of the validating Webhook, matching the --validate-path of the controller")
+	logLevel := flag.String("log-level", logging.InfoLevel.String(), "The minimum level of the log lines: debug, info, warn or error, also settable at runtime on /loglevel")
+	flag.Parse()
+
+	log := logging.Default()
+	logging.RedirectKlog(log)
+	level, err := logging.ParseLevel(*logLevel)
 	if err != nil {
-		log.Fatalf("Error building Kubernetes config: %v", err)
+		log.Fatal("Invalid --log-level flag", "error", err)
 	}
+	log.SetLevel(level)
 
-	client, err := kubernetes.NewForConfig(config)
+	webhookConfig, err := loadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Error building Kubernetes client: %v", err)
+		log.Fatal("Failed to load the configuration", "error", err)
+	}
+	// The controller registers the validating Webhook with failurePolicy: Ignore unless told otherwise
+	if enforced := webhookConfig.Validation.enforcedPolicies(); len(enforced) > 0 {
+		log.Warn("Policies are enforced, the controller must run with --enforce-validation for the Pods not to be admitted unchecked when the Webhook is unavailable", "policies", enforced)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", mutateFunc)
-	server := &http.Server{
-		Addr:    ":10250",
-		Handler: mux,
-		TLSConfig: &tls.Config{
-			GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				secret, err := client.CoreV1().Secrets(constants.Namespace).Get(constants.SecretName, metav1.GetOptions{})
-				if err != nil {
-					log.Fatalf("Failed to get Secret %s/%s : %v", constants.Namespace, constants.SecretName, err)
-				}
-
-				cert, err := certificate.ParseSecretData(secret.Data)
-				if err != nil {
-					log.Fatalf("Failed to parse Secret %s/%s : %v", constants.Namespace, constants.SecretName, err)
-				}
-				return &cert, nil
-			},
-		},
-	}
-	log.Fatal(server.ListenAndServeTLS("", ""))
-}
-
-func mutateFunc(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		log.Printf("invalid method %s, only POST requests are allowed", r.Method)
-		return
+	mode, err := mutation.ParseInjectionMode(*defaultMode)
+	if err != nil {
+		log.Fatal("Invalid --mode flag", "error", err)
+	}
+	profileNames, err := mutation.ParseProfiles(*defaultProfiles)
+	if err != nil {
+		log.Fatal("Invalid --profiles flag", "error", err)
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	if *breakerThreshold < 0 || *breakerWindow <= 0 || *breakerCooldown <= 0 {
+		log.Fatal("Invalid circuit breaker flags: the threshold must not be negative and the durations must be positive")
+	}
+	if *maxRequestBytes <= 0 || *maxInFlight <= 0 {
+		log.Fatal("Invalid limits: --max-request-bytes and --max-in-flight must be positive")
+	}
+	auth, err := parseClientAuth(*clientAuthFlag)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("could not read request body: %v", err)
-		return
+		log.Fatal("Invalid --client-auth flag", "error", err)
+	}
+	if (auth == certClientAuth) != (*clientCAFile != "") {
+		log.Fatal("Invalid --client-ca-file flag: it is required by, and only valid with, --client-auth=" + string(certClientAuth))
+	}
+	allowed := make(map[string]bool)
+	for _, name := range splitList(*allowedClients) {
+		allowed[name] = true
+	}
+	if auth == noClientAuth && len(allowed) > 0 {
+		log.Fatal("Invalid --allowed-clients flag: it requires --client-auth")
+	}
+	// Any ServiceAccount of the cluster has a token the TokenReview authenticates
+	if auth == tokenClientAuth && (len(allowed) == 0 || *tokenAudience == "") {
+		log.Fatal("Invalid --allowed-clients or --token-audience flag: --client-auth=" + string(tokenClientAuth) + " requires both")
+	}
+	if *breakerThreshold > 0 && !*failOpenEnabled {
+		log.Fatal("Invalid --breaker-threshold flag: the circuit breaker requires --fail-open")
 	}
-	defer r.Body.Close()
 
-	if contentType := r.Header.Get("Content-Type"); contentType != jsonContentType {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
-		return
+	if *port < 1 || *port > 65535 || *metricsPort < 0 || *metricsPort > 65535 || *metricsPort == *port {
+		log.Fatal("Invalid --port or --metrics-port flag: the ports must be valid and distinct", "port", *port, "metricsPort", *metricsPort)
+	}
+	paths := map[string]string{"mutate": *mutatePath, "validate": *validatePath}
+	for webhook, path := range paths {
+		if !strings.HasPrefix(path, "/") || path == "/metrics" || path == "/healthz" || path == "/loglevel" {
+			log.Fatal("Invalid --"+webhook+"-path flag: the path must start with / and not be /metrics, /healthz or /loglevel", "path", path)
+		}
+	}
+	if *mutatePath == *validatePath {
+		log.Fatal("Invalid --mutate-path and --validate-path flags: the paths must be distinct", "path", *mutatePath)
 	}
 
-	var admissionReviewReq admiv1beta1.AdmissionReview
-	if _, _, err := deserializer.Decode(body, nil, &admissionReviewReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("could not deserialize request: %v", err)
-		return
-	} else if admissionReviewReq.Request == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Println("malformed admission review: request is nil")
-		return
+	// The flags set explicitly override the TLS policy of the configuration file
+	policy := webhookConfig.TLS
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "tls-min-version":
+			policy.MinVersion = *tlsMinVersion
+		case "tls-cipher-suites":
+			policy.CipherSuites = splitList(*tlsCipherSuites)
+		case "tls-curve-preferences":
+			policy.CurvePreferences = splitList(*tlsCurvePreferences)
+		case "http2":
+			policy.HTTP2 = http2
+		}
+	})
+	tlsConfig := &tls.Config{}
+	server := &http.Server{
+		Addr: fmt.Sprintf(":%d", *port),
+		// The API Server gives up on the requests after the timeout of the Webhook
+		ReadTimeout:  constants.WebhookTimeoutSeconds * time.Second,
+		WriteTimeout: constants.WebhookTimeoutSeconds * time.Second,
+		IdleTimeout:  90 * time.Second,
+		TLSConfig:    tlsConfig,
+	}
+	if err := policy.apply(tlsConfig, server); err != nil {
+		log.Fatal("Invalid TLS policy", "error", err)
 	}
 
-	var admissionReviewResp admiv1beta1.AdmissionReview
-	resp, err := mutate(admissionReviewReq.Request)
+	// TODO: use signals to close this channel
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	config, err := clientcmd.BuildConfigFromFlags("", "")
 	if err != nil {
-		log.Printf("Failed to mutate: %v", err) // TODO(bancel): better message
-		admissionReviewResp = admiv1beta1.AdmissionReview{
-			Response: &admiv1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-				Allowed: false,
-			},
-		}
-	} else {
-		admissionReviewResp = admiv1beta1.AdmissionReview{
-			Response: resp,
-		}
+		log.Fatal("Error building Kubernetes config", "error", err)
 	}
-	admissionReviewResp.Response.UID = admissionReviewReq.Request.UID
 
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(&admissionReviewResp)
+	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		klog.Errorf("failed to encode the response: %v", err)
-		return
+		log.Fatal("Error building Kubernetes client", "error", err)
 	}
-}
 
-func mutate(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
-	var pod corev1.Pod
-	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-		return nil, fmt.Errorf("failed to decode raw object: %w", err)
+	// The Namespaces are watched to resolve the injection mode configured on them.
+	informerFactory := kubeinformers.NewSharedInformerFactory(client, 24*time.Hour)
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+	mutators, err := mutation.NewBuiltinMutators(&webhookConfig.Config, namespaceInformer.Lister(), mode, profileNames)
+	if err != nil {
+		log.Fatal("Failed to create the Mutators", "error", err)
+	}
+	pipeline := mutation.NewPipeline(mutators...)
+	v := &validator{
+		namespaceLister: namespaceInformer.Lister(),
+		config:          &webhookConfig.Validation,
+	}
+	informerFactory.Start(stopCh)
+	if ok := cache.WaitForCacheSync(stopCh, namespaceInformer.Informer().HasSynced); !ok {
+		log.Fatal("Failed to wait for the Namespace cache to sync")
 	}
 
-	resp := &admiv1beta1.AdmissionResponse{Allowed: true}
+	registry := metrics.NewRegistry()
+	admissionMetrics := newAdmissionMetrics(registry)
 
-	for i, container := range pod.Spec.Containers {
-		// Skip the Knative Queue Proxy container
-		if container.Name == "queue-proxy" {
-			continue
+	mux := http.NewServeMux()
+	// The panics are recovered before failing open
+	mutate := recoverPanics(pipeline.Mutate)
+	if *failOpenEnabled {
+		f := &failOpen{webhook: "mutate", admit: mutate, metrics: admissionMetrics}
+		if *breakerThreshold > 0 {
+			f.breaker = newBreaker(*breakerThreshold, *breakerWindow, *breakerCooldown)
 		}
-
-		// Find out if there is already an environment variable defined where we want to add one
-		found := false
-		for _, env := range container.Env {
-			if env.Name == envVarName {
-				klog.Warningf("Container %q already contains an environment variable entry for %q. Keeping the original value.", container, envVarName)
-				found = true
-				break
-			}
+		mutate = f.admitOrPass
+	}
+	limits := newHandlerLimits(*maxRequestBytes, *maxInFlight)
+	handlers := map[string]http.Handler{
+		"mutate":   admissionHandler("mutate", mutate, admissionMetrics, limits),
+		"validate": admissionHandler("validate", v.validate, admissionMetrics, limits),
+	}
+	tlsConfig.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		secret, err := client.CoreV1().Secrets(constants.Namespace).Get(constants.SecretName, metav1.GetOptions{})
+		if err != nil {
+			log.Fatal("Failed to get the Secret", "secret", constants.Namespace+"/"+constants.SecretName, "error", err)
 		}
 
-		// Add the environment variable definition
-		if !found {
-			pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, corev1.EnvVar{
-				Name:  envVarName,
-				Value: "",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "status.hostIP",
-					},
-				},
-			})
+		cert, err := certificate.ParseSecretData(secret.Data)
+		if err != nil {
+			log.Fatal("Failed to parse the Secret", "secret", constants.Namespace+"/"+constants.SecretName, "error", err)
 		}
+		return &cert, nil
 	}
-
-	bytes, err := json.Marshal(pod)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode the mutated Pod object: %w", err)
+	var clientAuthenticator authenticator
+	switch auth {
+	case certClientAuth:
+		clientCAs, err := loadClientCAs(*clientCAFile)
+		if err != nil {
+			log.Fatal("Invalid --client-ca-file flag", "error", err)
+		}
+		// The certificate is only required on the admission endpoints
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		clientAuthenticator = certAuthenticator{}
+	case tokenClientAuth:
+		clientAuthenticator = newTokenAuthenticator(client.AuthenticationV1().TokenReviews(), *tokenAudience)
 	}
-	patch, err := jsonpatch.CreatePatch(req.Object.Raw, bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compute the JSON patch: %w", err)
+	for webhook, handler := range handlers {
+		if clientAuthenticator != nil {
+			handler = withAuthentication(webhook, handler, clientAuthenticator, allowed, admissionMetrics)
+		}
+		mux.Handle(paths[webhook], handler)
 	}
-	resp.Patch, err = json.Marshal(patch)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode the JSON patch: %w", err)
+	// The probes and the scrapes don't go through the authentication of the admission endpoints
+	metricsMux := mux
+	if *metricsPort != 0 {
+		metricsMux = http.NewServeMux()
+		metricsServer := &http.Server{
+			Addr:         fmt.Sprintf(":%d", *metricsPort),
+			Handler:      metricsMux,
+			ReadTimeout:  constants.WebhookTimeoutSeconds * time.Second,
+			WriteTimeout: constants.WebhookTimeoutSeconds * time.Second,
+		}
+		go func() {
+			log.Fatal("Failed to serve the metrics", "error", metricsServer.ListenAndServe())
+		}()
 	}
-	return resp, nil
+	metricsMux.Handle("/metrics", registry)
+	metricsMux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	metricsMux.Handle("/loglevel", logging.LevelHandler(log))
+	server.Handler = mux
+	log.Info("Serving the admission endpoints", "port", *port, "metricsPort", *metricsPort)
+	log.Fatal("Failed to serve the admission endpoints", "error", server.ListenAndServeTLS("", ""))
 }
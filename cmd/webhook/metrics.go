@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/metrics"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+// Results of the admission requests.
+const (
+	allowedResult = "allowed"
+	patchedResult = "patched"
+	deniedResult  = "denied"
+	errorResult   = "error"
+)
+
+// admissionMetrics measures the admission requests. They are labeled by dry run, since the
+// dry-run requests don't create anything.
+type admissionMetrics struct {
+	requests     *metrics.CounterVec
+	duration     *metrics.HistogramVec
+	failOpen     *metrics.CounterVec
+	breakerTrips *metrics.CounterVec
+	shed         *metrics.CounterVec
+	// unauthenticated counts the requests of the clients not authenticated, or not allowed.
+	unauthenticated *metrics.CounterVec
+}
+
+func newAdmissionMetrics(registry *metrics.Registry) *admissionMetrics {
+	return &admissionMetrics{
+		requests: registry.NewCounterVec("admission_requests_total",
+			"The number of admission requests handled by the Webhook.", "webhook", "result", "dry_run"),
+		duration: registry.NewHistogramVec("admission_duration_seconds",
+			"The time taken to admit the requests.", metrics.DefaultDurationBuckets, "webhook", "dry_run"),
+		failOpen: registry.NewCounterVec("admission_fail_open_total",
+			"The number of objects admitted without being mutated, because of an error or of the open circuit breaker.", "webhook", "reason", "dry_run"),
+		breakerTrips: registry.NewCounterVec("admission_circuit_breaker_trips_total",
+			"The number of times the circuit breaker tripped.", "webhook"),
+		shed: registry.NewCounterVec("admission_shed_requests_total",
+			"The number of requests rejected because of the limit of in-flight requests.", "webhook"),
+		unauthenticated: registry.NewCounterVec("admission_unauthenticated_requests_total",
+			"The number of requests rejected because their client is not authenticated or not allowed.", "webhook", "reason"),
+	}
+}
+
+// observe records the admission of req by the Webhook named webhook, which took duration and
+// returned resp, or err.
+func (m *admissionMetrics) observe(webhook string, req *admiv1beta1.AdmissionRequest, resp *admiv1beta1.AdmissionResponse, err error, duration time.Duration) {
+	result := allowedResult
+	switch {
+	case mutation.IsDenied(err):
+		result = deniedResult
+	case err != nil:
+		result = errorResult
+	case !resp.Allowed:
+		result = deniedResult
+	case resp.Patch != nil:
+		result = patchedResult
+	}
+	dryRun := strconv.FormatBool(mutation.IsDryRun(req))
+	m.requests.Inc(webhook, result, dryRun)
+	m.duration.Observe(duration.Seconds(), webhook, dryRun)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/metrics"
+)
+
+func TestAdmissionMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	handler := admissionHandler("mutate", func(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+		return &admiv1beta1.AdmissionResponse{Allowed: true}, nil
+	}, newAdmissionMetrics(registry), newTestHandlerLimits())
+
+	dryRun := true
+	for _, req := range []*admiv1beta1.AdmissionRequest{
+		newAdmissionRequest(t, newAnnotatedPod(nil)),
+		newAdmissionRequest(t, newAnnotatedPod(nil)),
+		func() *admiv1beta1.AdmissionRequest {
+			req := newAdmissionRequest(t, &corev1.Pod{})
+			req.DryRun = &dryRun
+			return req
+		}(),
+	} {
+		handler(httptest.NewRecorder(), newReviewRequest(t, req, jsonContentType))
+	}
+
+	var b bytes.Buffer
+	if err := registry.Write(&b); err != nil {
+		t.Fatalf("Failed to write the metrics: %v", err)
+	}
+	for _, expected := range []string{
+		`admission_requests_total{webhook="mutate",result="allowed",dry_run="false"} 2`,
+		`admission_requests_total{webhook="mutate",result="allowed",dry_run="true"} 1`,
+		`admission_duration_seconds_count{webhook="mutate",dry_run="true"} 1`,
+	} {
+		if !strings.Contains(b.String(), expected+"\n") {
+			t.Errorf("Missing %q in:\n%s", expected, b.String())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tlsVersions are the supported values of --tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the supported values of --tls-curve-preferences.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// defaultTLSMinVersion is the minimum version of TLS when none is configured.
+const defaultTLSMinVersion = "1.2"
+
+// tlsPolicy is the TLS configuration of the server, on top of its certificate. It is read from the
+// configuration file, then overridden by the flags.
+type tlsPolicy struct {
+	// MinVersion is the minimum version of TLS: 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2.
+	MinVersion string `json:"minVersion,omitempty"`
+	// CipherSuites are the names of the cipher suites of TLS 1.0 to 1.2, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. The secure suites of Go are used if empty.
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	// CurvePreferences are the names of the elliptic curves, by order of preference: X25519, P256,
+	// P384 or P521. The default curves of Go are used if empty.
+	CurvePreferences []string `json:"curvePreferences,omitempty"`
+	// HTTP2 enables HTTP/2. Defaults to true.
+	HTTP2 *bool `json:"http2,omitempty"`
+}
+
+func (p *tlsPolicy) http2() bool {
+	return p.HTTP2 == nil || *p.HTTP2
+}
+
+// apply configures config and server according to the policy. It returns an error if a value is
+// unknown or if the values are incompatible.
+func (p *tlsPolicy) apply(config *tls.Config, server *http.Server) error {
+	version := p.MinVersion
+	if version == "" {
+		version = defaultTLSMinVersion
+	}
+	minVersion, ok := tlsVersions[version]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2, 1.3", version)
+	}
+
+	suites, err := parseCipherSuites(p.CipherSuites)
+	if err != nil {
+		return err
+	}
+	if len(suites) > 0 {
+		if minVersion == tls.VersionTLS13 {
+			return fmt.Errorf("the cipher suites only apply below TLS 1.3, the minimum version must be lower")
+		}
+		if err := checkCipherSuites(suites, p.http2()); err != nil {
+			return err
+		}
+	}
+
+	var curves []tls.CurveID
+	for _, name := range p.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("unknown curve %q, must be one of X25519, P256, P384, P521", name)
+		}
+		curves = append(curves, curve)
+	}
+
+	config.MinVersion = minVersion
+	for _, suite := range suites {
+		config.CipherSuites = append(config.CipherSuites, suite.ID)
+	}
+	config.CurvePreferences = curves
+	if !p.http2() {
+		// A non-nil empty map disables HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return nil
+}
+
+// parseCipherSuites returns the cipher suites named names. The insecure suites and the suites of
+// TLS 1.3 are rejected.
+func parseCipherSuites(names []string) ([]*tls.CipherSuite, error) {
+	secure := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var suites []*tls.CipherSuite
+	for _, name := range names {
+		suite, ok := secure[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("the cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		case !supportsVersion(suite, tls.VersionTLS12):
+			return nil, fmt.Errorf("the cipher suite %s belongs to TLS 1.3, whose cipher suites are not configurable", name)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// checkCipherSuites returns an error if no suite is usable with the RSA certificate of the
+// Webhook, or if HTTP/2 is enabled without the suite it requires.
+func checkCipherSuites(suites []*tls.CipherSuite, http2 bool) error {
+	rsa, http2Required := false, false
+	for _, suite := range suites {
+		if !strings.Contains(suite.Name, "_ECDSA_") {
+			rsa = true
+		}
+		if suite.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+			http2Required = true
+		}
+	}
+	if !rsa {
+		return fmt.Errorf("none of the cipher suites supports the RSA certificate of the Webhook")
+	}
+	if http2 && !http2Required {
+		return fmt.Errorf("HTTP/2 requires the cipher suite TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, add it or disable HTTP/2")
+	}
+	return nil
+}
+
+func supportsVersion(suite *tls.CipherSuite, version uint16) bool {
+	for _, v := range suite.SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList returns the trimmed non-empty elements of the comma-separated list s.
+func splitList(s string) []string {
+	var elements []string
+	for _, element := range strings.Split(s, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
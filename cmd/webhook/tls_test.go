@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name     string
+		policy   tlsPolicy
+		expected *tls.Config
+		http2    bool
+	}{{
+		name:     "default",
+		expected: &tls.Config{MinVersion: tls.VersionTLS12},
+		http2:    true,
+	}, {
+		name: "configured",
+		policy: tlsPolicy{
+			MinVersion:       "1.2",
+			CipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			CurvePreferences: []string{"X25519", "P256"},
+		},
+		expected: &tls.Config{
+			MinVersion:       tls.VersionTLS12,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		},
+		http2: true,
+	}, {
+		name: "HTTP/2 disabled",
+		policy: tlsPolicy{
+			MinVersion: "1.3",
+			HTTP2:      &disabled,
+		},
+		expected: &tls.Config{MinVersion: tls.VersionTLS13},
+	}, {
+		name: "suites without the one of HTTP/2, HTTP/2 disabled",
+		policy: tlsPolicy{
+			CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+			HTTP2:        &disabled,
+		},
+		expected: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, server := &tls.Config{}, &http.Server{}
+			if err := test.policy.apply(config, server); err != nil {
+				t.Fatalf("Failed to apply the policy: %v", err)
+			}
+			if !reflect.DeepEqual(config, test.expected) {
+				t.Errorf("Unexpected TLS configuration: got %+v, want %+v", config, test.expected)
+			}
+			if http2 := server.TLSNextProto == nil; http2 != test.http2 {
+				t.Errorf("Unexpected HTTP/2: got %t, want %t", http2, test.http2)
+			}
+		})
+	}
+}
+
+func TestInvalidTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy tlsPolicy
+	}{{
+		name:   "unknown version",
+		policy: tlsPolicy{MinVersion: "1.4"},
+	}, {
+		name:   "unknown cipher suite",
+		policy: tlsPolicy{CipherSuites: []string{"TLS_FOO"}},
+	}, {
+		name:   "insecure cipher suite",
+		policy: tlsPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}},
+	}, {
+		name:   "TLS 1.3 cipher suite",
+		policy: tlsPolicy{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+	}, {
+		name:   "cipher suites with TLS 1.3",
+		policy: tlsPolicy{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+	}, {
+		name:   "no RSA cipher suite",
+		policy: tlsPolicy{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+	}, {
+		name:   "HTTP/2 without its cipher suite",
+		policy: tlsPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+	}, {
+		name:   "unknown curve",
+		policy: tlsPolicy{CurvePreferences: []string{"P224"}},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.policy.apply(&tls.Config{}, &http.Server{}); err == nil {
+				t.Fatalf("The policy should be rejected")
+			}
+		})
+	}
+}
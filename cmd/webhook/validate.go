@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+// policyAction defines what happens when a Pod violates a policy.
+type policyAction string
+
+const (
+	// offAction disables the policy, it is the default.
+	offAction policyAction = "off"
+	// warnAction admits the Pod but records the violation.
+	warnAction policyAction = "warn"
+	// enforceAction rejects the Pod.
+	enforceAction policyAction = "enforce"
+)
+
+const (
+	// hostNetworkReasonAnnotation justifies the use of the host network by a Pod.
+	hostNetworkReasonAnnotation = "node-ip-webhook/host-network-reason"
+	// requireUnifiedServiceTaggingAnnotation enables the unifiedServiceTagging policy for the Pods of a Namespace.
+	requireUnifiedServiceTaggingAnnotation = "node-ip-webhook/require-unified-service-tagging"
+
+	// policyWarningsAuditAnnotation records the violations of the policies in warn mode.
+	policyWarningsAuditAnnotation = "policy-warnings"
+
+	// policyViolationCause is the type of the causes of the denials, one per violation.
+	policyViolationCause metav1.CauseType = "PolicyViolation"
+)
+
+// validationConfig sets the action of each policy.
+type validationConfig struct {
+	// LiteralAgentHost forbids setting DD_AGENT_HOST to a literal IP, which breaks when the Pod moves.
+	LiteralAgentHost policyAction `json:"literalAgentHost"`
+	// HostNetwork forbids the host network unless the Pod is annotated with hostNetworkReasonAnnotation.
+	HostNetwork policyAction `json:"hostNetwork"`
+	// UnifiedServiceTagging requires the unified service tagging labels in the Namespaces annotated
+	// with requireUnifiedServiceTaggingAnnotation.
+	UnifiedServiceTagging policyAction `json:"unifiedServiceTagging"`
+}
+
+// validate returns an error if an action is unknown.
+func (c *validationConfig) validate() error {
+	for _, p := range c.policies() {
+		switch p.action {
+		case "", offAction, warnAction, enforceAction:
+		default:
+			return fmt.Errorf("unknown action %q for %s, must be one of %q, %q, %q", p.action, p.name, offAction, warnAction, enforceAction)
+		}
+	}
+	return nil
+}
+
+// enforcedPolicies returns the names of the policies rejecting the Pods.
+func (c *validationConfig) enforcedPolicies() []string {
+	var names []string
+	for _, p := range c.policies() {
+		if p.action == enforceAction {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// policy checks the Pods against a rule.
+type policy struct {
+	name   string
+	action policyAction
+	// check returns the violations of the Pod template, admitted in namespace.
+	check func(v *validator, template *mutation.PodTemplate, namespace string) ([]string, error)
+}
+
+// policies returns the policies along with their configured action.
+func (c *validationConfig) policies() []policy {
+	return []policy{
+		{name: "literalAgentHost", action: c.LiteralAgentHost, check: checkLiteralAgentHost},
+		{name: "hostNetwork", action: c.HostNetwork, check: checkHostNetwork},
+		{name: "unifiedServiceTagging", action: c.UnifiedServiceTagging, check: checkUnifiedServiceTagging},
+	}
+}
+
+// validator holds what is needed to validate the admitted Pods.
+type validator struct {
+	namespaceLister corelisters.NamespaceLister
+	config          *validationConfig
+}
+
+// validate checks the admitted Pod against the enabled policies. The violations of the enforced
+// policies reject it, the others are logged and recorded in an audit annotation.
+func (v *validator) validate(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+	template, err := mutation.DecodePodTemplate(req.Kind, req.Object.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var denials, warnings []string
+	for _, p := range v.config.policies() {
+		if p.action == "" || p.action == offAction {
+			continue
+		}
+		violations, err := p.check(v, template, req.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the %s policy: %w", p.name, err)
+		}
+		for _, violation := range violations {
+			message := p.name + ": " + violation
+			if p.action == enforceAction {
+				denials = append(denials, message)
+			} else {
+				warnings = append(warnings, message)
+			}
+		}
+	}
+
+	if len(denials) > 0 {
+		status := newStatus(req, http.StatusForbidden, metav1.StatusReasonForbidden,
+			"the Pod violates the observability policies: "+strings.Join(denials, "; "))
+		for _, denial := range denials {
+			status.Details.Causes = append(status.Details.Causes, metav1.StatusCause{Type: policyViolationCause, Message: denial})
+		}
+		return &admiv1beta1.AdmissionResponse{Allowed: false, Result: status}, nil
+	}
+	resp := &admiv1beta1.AdmissionResponse{Allowed: true}
+	if len(warnings) > 0 {
+		logging.ForAdmission(req).Warn("The Pod violates the observability policies", "violations", warnings)
+		resp.AuditAnnotations = map[string]string{policyWarningsAuditAnnotation: strings.Join(warnings, "; ")}
+	}
+	return resp, nil
+}
+
+// checkLiteralAgentHost reports the containers setting DD_AGENT_HOST to an IP.
+func checkLiteralAgentHost(_ *validator, template *mutation.PodTemplate, _ string) ([]string, error) {
+	var violations []string
+	for _, container := range template.Spec.Containers {
+		for _, envVar := range container.Env {
+			if envVar.Name == mutation.AgentHostEnvVarName && envVar.ValueFrom == nil && net.ParseIP(envVar.Value) != nil {
+				violations = append(violations, fmt.Sprintf("container %q sets %s to the literal IP %s", container.Name, mutation.AgentHostEnvVarName, envVar.Value))
+			}
+		}
+	}
+	return violations, nil
+}
+
+// checkHostNetwork reports the use of the host network without hostNetworkReasonAnnotation.
+func checkHostNetwork(_ *validator, template *mutation.PodTemplate, _ string) ([]string, error) {
+	if !template.Spec.HostNetwork || strings.TrimSpace(template.Annotations[hostNetworkReasonAnnotation]) != "" {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("hostNetwork is set without the %q annotation", hostNetworkReasonAnnotation)}, nil
+}
+
+// checkUnifiedServiceTagging reports the unified service tags without any of their labels, if
+// the Namespace requires them.
+func checkUnifiedServiceTagging(v *validator, template *mutation.PodTemplate, namespace string) ([]string, error) {
+	ns, err := v.namespaceLister.Get(namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get the Namespace %q: %w", namespace, err)
+	}
+	if ns.Annotations[requireUnifiedServiceTaggingAnnotation] != "true" {
+		return nil, nil
+	}
+
+	missing := mutation.MissingUnifiedServiceTagLabels(template.ExpectedPodLabels())
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("missing the labels %s", strings.Join(missing, ", "))}, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
+)
+
+func TestValidate(t *testing.T) {
+	enforced := &validationConfig{
+		LiteralAgentHost:      enforceAction,
+		HostNetwork:           enforceAction,
+		UnifiedServiceTagging: enforceAction,
+	}
+	warned := &validationConfig{
+		LiteralAgentHost:      warnAction,
+		HostNetwork:           warnAction,
+		UnifiedServiceTagging: warnAction,
+	}
+	requiringNamespace := newAnnotatedNamespace(map[string]string{requireUnifiedServiceTaggingAnnotation: "true"})
+	taggedLabels := map[string]string{
+		"tags.datadoghq.com/env":     "prod",
+		"tags.datadoghq.com/service": "api",
+		"tags.datadoghq.com/version": "1.0",
+	}
+	hostIPEnvVar := corev1.EnvVar{
+		Name:      mutation.AgentHostEnvVarName,
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"}},
+	}
+
+	tests := []struct {
+		name      string
+		config    *validationConfig
+		namespace *corev1.Namespace
+		pod       *corev1.Pod
+		allowed   bool
+		warnings  string
+	}{{
+		name:    "policies off",
+		config:  &validationConfig{},
+		pod:     withHostNetwork(newAnnotatedPod(nil)),
+		allowed: true,
+	}, {
+		name:    "compliant pod",
+		config:  enforced,
+		pod:     withEnv(newAnnotatedPod(nil), hostIPEnvVar),
+		allowed: true,
+	}, {
+		name:   "literal agent host",
+		config: enforced,
+		pod:    withEnv(newAnnotatedPod(nil), corev1.EnvVar{Name: mutation.AgentHostEnvVarName, Value: "10.0.0.1"}),
+	}, {
+		name:    "agent host name",
+		config:  enforced,
+		pod:     withEnv(newAnnotatedPod(nil), corev1.EnvVar{Name: mutation.AgentHostEnvVarName, Value: "datadog-agent.datadog.svc"}),
+		allowed: true,
+	}, {
+		name:   "host network without reason",
+		config: enforced,
+		pod:    withHostNetwork(newAnnotatedPod(nil)),
+	}, {
+		name:    "host network with reason",
+		config:  enforced,
+		pod:     withHostNetwork(newAnnotatedPod(map[string]string{hostNetworkReasonAnnotation: "CNI plugin"})),
+		allowed: true,
+	}, {
+		name:      "missing tagging labels in a requiring namespace",
+		config:    enforced,
+		namespace: requiringNamespace,
+		pod:       newAnnotatedPod(nil),
+	}, {
+		name:      "tagging labels in a requiring namespace",
+		config:    enforced,
+		namespace: requiringNamespace,
+		pod: func() *corev1.Pod {
+			pod := newAnnotatedPod(nil)
+			pod.Labels = taggedLabels
+			return pod
+		}(),
+		allowed: true,
+	}, {
+		name:    "missing tagging labels in another namespace",
+		config:  enforced,
+		pod:     newAnnotatedPod(nil),
+		allowed: true,
+	}, {
+		name:      "warnings",
+		config:    warned,
+		namespace: requiringNamespace,
+		pod:       withHostNetwork(withEnv(newAnnotatedPod(nil), corev1.EnvVar{Name: mutation.AgentHostEnvVarName, Value: "10.0.0.1"})),
+		allowed:   true,
+		warnings: `literalAgentHost: container "user-container" sets DD_AGENT_HOST to the literal IP 10.0.0.1; ` +
+			`hostNetwork: hostNetwork is set without the "node-ip-webhook/host-network-reason" annotation; ` +
+			`unifiedServiceTagging: missing the labels tags.datadoghq.com/env, tags.datadoghq.com/service, tags.datadoghq.com/version`,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if test.namespace != nil {
+				_ = indexer.Add(test.namespace)
+			}
+			v := &validator{namespaceLister: corelisters.NewNamespaceLister(indexer), config: test.config}
+
+			resp, err := v.validate(newAdmissionRequest(t, test.pod))
+			if err != nil {
+				t.Fatalf("Failed to validate: %v", err)
+			}
+			if resp.Allowed != test.allowed {
+				t.Fatalf("Unexpected admission: got %t, want %t: %v", resp.Allowed, test.allowed, resp.Result)
+			}
+			if !resp.Allowed && (resp.Result.Code != http.StatusForbidden || resp.Result.Reason != metav1.StatusReasonForbidden || len(resp.Result.Details.Causes) == 0) {
+				t.Fatalf("The denial should be detailed: %v", resp.Result)
+			}
+			var expected map[string]string
+			if test.warnings != "" {
+				expected = map[string]string{policyWarningsAuditAnnotation: test.warnings}
+			}
+			if !reflect.DeepEqual(resp.AuditAnnotations, expected) {
+				t.Fatalf("Unexpected audit annotations: got %v, want %v", resp.AuditAnnotations, expected)
+			}
+		})
+	}
+}
+
+func newAnnotatedNamespace(annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: annotations}}
+}
+
+func newAnnotatedPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "user-container"}}},
+	}
+}
+
+func newAdmissionRequest(t *testing.T, pod *corev1.Pod) *admiv1beta1.AdmissionRequest {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("Failed to encode the Pod: %v", err)
+	}
+	return &admiv1beta1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: admiv1beta1.Create,
+		Namespace: pod.Namespace,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func withEnv(pod *corev1.Pod, envVars ...corev1.EnvVar) *corev1.Pod {
+	pod.Spec.Containers[0].Env = envVars
+	return pod
+}
+
+func withHostNetwork(pod *corev1.Pod) *corev1.Pod {
+	pod.Spec.HostNetwork = true
+	return pod
+}
+
+func TestEnforcedPolicies(t *testing.T) {
+	c := &validationConfig{LiteralAgentHost: enforceAction, HostNetwork: warnAction, UnifiedServiceTagging: enforceAction}
+	expected := []string{"literalAgentHost", "unifiedServiceTagging"}
+	if enforced := c.enforcedPolicies(); !reflect.DeepEqual(enforced, expected) {
+		t.Fatalf("Unexpected enforced policies: got %v, want %v", enforced, expected)
+	}
+	if enforced := (&validationConfig{HostNetwork: warnAction}).enforcedPolicies(); len(enforced) != 0 {
+		t.Fatalf("No policy should be enforced: %v", enforced)
+	}
+}
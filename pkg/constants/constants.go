@@ -12,4 +12,14 @@ const (
 
 	// ServiceName is the name of the Kubernetes Service pointing to the Webhook implementation inside `Namespace`
 	ServiceName = "webhook"
+
+	// ServicePort is the default port of the Service pointing to the Webhook implementation
+	ServicePort = 443
+
+	// MutatePath and ValidatePath are the default paths of the mutating and validating Webhooks
+	MutatePath   = "/mutate"
+	ValidatePath = "/validate"
+
+	// WebhookTimeoutSeconds is the time the API Server waits for the Webhook before applying the failure policy
+	WebhookTimeoutSeconds = 10
 )
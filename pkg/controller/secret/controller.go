@@ -14,9 +14,9 @@ import (
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
-	"k8s.io/klog"
 
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/certificate"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
 )
 
 var (
@@ -41,6 +41,8 @@ type Controller struct {
 	secretsSynced cache.InformerSynced
 
 	workQueue workqueue.RateLimitingInterface
+
+	log *logging.Logger
 }
 
 // NewController returns a new Secret Controller.
@@ -56,6 +58,7 @@ func NewController(
 		secretsLister:   secretInformer.Lister(),
 		secretsSynced:   secretInformer.Informer().HasSynced,
 		workQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "SecretController"),
+		log:             logging.Default().With("controller", "secret"),
 	}
 
 	secretInformer.Informer().AddEventHandler(createSecretEventHandler(controller))
@@ -90,10 +93,10 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 	defer c.workQueue.ShutDown()
 
 	// Start the informer factories to begin populating the informer caches
-	klog.Infof("Starting the Secret controller for '%s/%s'", c.secretNamespace, c.secretName)
+	c.log.Info("Starting the Secret controller", "secret", c.secretNamespace+"/"+c.secretName)
 
 	// Wait for the caches to be synced before starting workers
-	klog.Info("Waiting for informer caches to sync...")
+	c.log.Info("Waiting for informer caches to sync")
 	if ok := cache.WaitForCacheSync(stopCh, c.secretsSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
@@ -103,9 +106,9 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 	// Trigger a reconciliation to create the Secret if it doesn't exist
 	c.workQueue.Add(struct{}{})
 
-	klog.Info("Successfully started!")
+	c.log.Info("Successfully started")
 	<-stopCh
-	klog.Info("Shutting down workers")
+	c.log.Info("Shutting down workers")
 
 	return nil
 }
@@ -128,26 +131,28 @@ func (c *Controller) processNextWorkItem() bool {
 	func() {
 		// Done() must always be called
 		defer c.workQueue.Done(obj)
-		if err := c.reconcileSecret(); err != nil {
-			// Requeue for retry
-			c.workQueue.AddRateLimited(struct{}{})
-			klog.Errorf("Failed to reconcile the Secret '%s/%s': %v", c.secretNamespace, c.secretName, err)
+		log := c.log.With("key", c.secretNamespace+"/"+c.secretName, "attempt", c.workQueue.NumRequeues(obj)+1)
+		if err := c.reconcileSecret(log); err != nil {
+			// Requeue for retry, the rate limiter counts the attempts until the item is forgotten
+			c.workQueue.AddRateLimited(obj)
+			log.Error("Failed to reconcile the Secret", "error", err)
+			return
 		}
 		// Remove from the queue
 		c.workQueue.Forget(obj)
-		klog.Infof("Successfully reconciled the Secret '%s/%s'", c.secretNamespace, c.secretName)
+		log.Info("Successfully reconciled the Secret")
 	}()
 
 	return true
 }
 
 // reconcileSecret reconcile the current state of the Secret with its desired state.
-func (c *Controller) reconcileSecret() error {
+func (c *Controller) reconcileSecret(log *logging.Logger) error {
 	secret, err := c.secretsLister.Secrets(c.secretNamespace).Get(c.secretName)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// If the Secret doesn't exist, it needs to be created.
-			klog.Infof("The Secret %s/%s was not found, creating it.", c.secretNamespace, c.secretName)
+			log.Info("The Secret was not found, creating it")
 			return c.createSecret()
 		}
 		return err
@@ -156,11 +161,11 @@ func (c *Controller) reconcileSecret() error {
 	// If the Secret is close to expiration, it needs to be refreshed
 	durationBeforeExpiration, err := certificate.GetDurationBeforeExpiration(secret.Data)
 	if err != nil || durationBeforeExpiration < expirationThreshold {
-		klog.Infof("The certificate is expiring soon (%v), refreshing it.", durationBeforeExpiration)
+		log.Info("The certificate is expiring soon, refreshing it", "expiresIn", durationBeforeExpiration, "error", err)
 		return c.updateSecret(secret)
 	}
 
-	klog.Infof("The certificate is not expiring soon (%v), doing nothing.", durationBeforeExpiration)
+	log.Info("The certificate is not expiring soon, doing nothing", "expiresIn", durationBeforeExpiration)
 	return nil
 }
 
@@ -146,7 +146,7 @@ func (f *fixture) run(t *testing.T) *Controller {
 	go func() {
 		err := c.Run(stopCh)
 		if err != nil {
-			t.Fatalf("Failed to run controller: %v", err)
+			t.Errorf("Failed to run controller: %v", err)
 		}
 	}()
 
@@ -19,17 +19,46 @@ import (
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
-	"k8s.io/klog"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/constants"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/mutation"
 )
 
+// ServiceConfig locates the admission endpoints behind the Webhook Service.
+type ServiceConfig struct {
+	// Port is the port of the Service.
+	Port int32
+	// MutatePath is the path of the mutating Webhook.
+	MutatePath string
+	// ValidatePath is the path of the validating Webhook.
+	ValidatePath string
+}
+
+// Options selects the Webhooks registered by the Controller.
+type Options struct {
+	// MutateWorkloads registers the workloads in addition to the Pods.
+	MutateWorkloads bool
+	// MutateKnative registers the Knative Services and Configurations in addition to the Pods.
+	MutateKnative bool
+	// Validate registers the validating Webhook, which is deleted otherwise.
+	Validate bool
+	// EnforceValidation registers the validating Webhook with failurePolicy: Fail rather than Ignore,
+	// since a Pod is only rejected by an enforced policy. It requires Validate.
+	EnforceValidation bool
+}
+
 // Controller is the controller in charge of watching the TLS certificate stored in the Secret
 // secretNamespace/secretName and deriving the Webhook webhookNamespace/webhookName from it.
+// When Options.Validate is set, it also derives the ValidatingWebhookConfiguration of the same name.
 type Controller struct {
 	kubeClient kubernetes.Interface
 
 	secretNamespace string
 	secretName      string
 	webhookName     string
+	service         ServiceConfig
+	options         Options
 
 	secretsLister corelisters.SecretLister
 	secretsSynced cache.InformerSynced
@@ -37,7 +66,12 @@ type Controller struct {
 	webhooksLister admissionlisters.MutatingWebhookConfigurationLister
 	webhooksSynced cache.InformerSynced
 
+	validatingWebhooksLister admissionlisters.ValidatingWebhookConfigurationLister
+	validatingWebhooksSynced cache.InformerSynced
+
 	workQueue workqueue.RateLimitingInterface
+
+	log *logging.Logger
 }
 
 // NewController returns a new Webhook Controller.
@@ -47,7 +81,10 @@ func NewController(
 	secretNamespace string,
 	secretName string,
 	webhookInformer admissioninformers.MutatingWebhookConfigurationInformer,
-	webhookName string) *Controller {
+	validatingWebhookInformer admissioninformers.ValidatingWebhookConfigurationInformer,
+	webhookName string,
+	service ServiceConfig,
+	options Options) *Controller {
 	controller := &Controller{
 		kubeClient:      kubeClient,
 		secretNamespace: secretNamespace,
@@ -55,13 +92,22 @@ func NewController(
 		secretsLister:   secretInformer.Lister(),
 		secretsSynced:   secretInformer.Informer().HasSynced,
 		webhookName:     webhookName,
+		service:         service,
+		options:         options,
 		webhooksLister:  webhookInformer.Lister(),
 		webhooksSynced:  webhookInformer.Informer().HasSynced,
-		workQueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "WebhookController"),
+
+		validatingWebhooksLister: validatingWebhookInformer.Lister(),
+		validatingWebhooksSynced: validatingWebhookInformer.Informer().HasSynced,
+
+		workQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "WebhookController"),
+
+		log: logging.Default().With("controller", "webhook"),
 	}
 
 	secretInformer.Informer().AddEventHandler(createSecretEventHandler(controller))
 	webhookInformer.Informer().AddEventHandler(createWebhookEventHandler(controller))
+	validatingWebhookInformer.Informer().AddEventHandler(createWebhookEventHandler(controller))
 
 	return controller
 }
@@ -105,12 +151,12 @@ func createWebhookEventHandler(c *Controller) cache.ResourceEventHandler {
 	}
 	return &cache.ResourceEventHandlerFuncs{
 		// If the Webhook is created or updated, we must make sure that its definition
-		// matches our expectation.
+		// matches our expectation. The handler is shared by the mutating and validating Webhooks.
 		AddFunc: handleObject,
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			newWebhook := newObj.(*admiv1beta1.MutatingWebhookConfiguration)
-			oldWebhook := oldObj.(*admiv1beta1.MutatingWebhookConfiguration)
-			if newWebhook.ResourceVersion == oldWebhook.ResourceVersion {
+			newWebhook := newObj.(metav1.Object)
+			oldWebhook := oldObj.(metav1.Object)
+			if newWebhook.GetResourceVersion() == oldWebhook.GetResourceVersion() {
 				return
 			}
 			handleObject(newObj)
@@ -129,14 +175,13 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 	defer c.workQueue.ShutDown()
 
 	// Start the informer factories to begin populating the informer caches
-	klog.Infof("Starting the Webhook controller for Secret '%s/%s' and Webhook '%s'",
-		c.secretNamespace,
-		c.secretName,
-		c.webhookName)
+	c.log.Info("Starting the Webhook controller",
+		"secret", c.secretNamespace+"/"+c.secretName,
+		"webhook", c.webhookName)
 
 	// Wait for the caches to be synced before starting workers
-	klog.Info("Waiting for informer caches to sync...")
-	if ok := cache.WaitForCacheSync(stopCh, c.secretsSynced, c.webhooksSynced); !ok {
+	c.log.Info("Waiting for informer caches to sync")
+	if ok := cache.WaitForCacheSync(stopCh, c.secretsSynced, c.webhooksSynced, c.validatingWebhooksSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -145,9 +190,9 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 	// Trigger a reconciliation to create the Webhook if it doesn't exist
 	c.workQueue.Add(struct{}{})
 
-	klog.Info("Successfully started!")
+	c.log.Info("Successfully started")
 	<-stopCh
-	klog.Info("Shutting down workers")
+	c.log.Info("Shutting down workers")
 
 	return nil
 }
@@ -170,21 +215,23 @@ func (c *Controller) processNextWorkItem() bool {
 	func() {
 		// Done() must always be called
 		defer c.workQueue.Done(obj)
-		if err := c.reconcileWebhook(); err != nil {
-			// Requeue for retry
-			c.workQueue.AddRateLimited(struct{}{})
-			klog.Errorf("Failed to reconcile the Webhook '%s': %v", c.webhookName, err)
+		log := c.log.With("key", c.webhookName, "attempt", c.workQueue.NumRequeues(obj)+1)
+		if err := c.reconcileWebhook(log); err != nil {
+			// Requeue for retry, the rate limiter counts the attempts until the item is forgotten
+			c.workQueue.AddRateLimited(obj)
+			log.Error("Failed to reconcile the Webhook", "error", err)
+			return
 		}
 		// Remove from the queue
 		c.workQueue.Forget(obj)
-		klog.Infof("Successfully reconciled the Webhook '%s'", c.webhookName)
+		log.Info("Successfully reconciled the Webhook")
 	}()
 
 	return true
 }
 
 // reconcileSecret reconcile the current state of the Webhook with its desired state.
-func (c *Controller) reconcileWebhook() error {
+func (c *Controller) reconcileWebhook(log *logging.Logger) error {
 	secret, err := c.secretsLister.Secrets(c.secretNamespace).Get(c.secretName)
 	if err != nil {
 		if errors.IsNotFound(err) {
@@ -195,14 +242,55 @@ func (c *Controller) reconcileWebhook() error {
 
 	webhook, err := c.webhooksLister.Get(c.webhookName)
 	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		log.Info("The Webhook was not found, creating it")
+		err = c.createWebhook(secret)
+	} else {
+		log.Info("The Webhook was found, updating it")
+		err = c.updateWebhook(secret, webhook)
+	}
+	if err != nil {
+		return err
+	}
+	return c.reconcileValidatingWebhook(log, secret)
+}
+
+// reconcileValidatingWebhook reconciles the current state of the validating Webhook with its desired state.
+func (c *Controller) reconcileValidatingWebhook(log *logging.Logger, secret *corev1.Secret) error {
+	webhook, err := c.validatingWebhooksLister.Get(c.webhookName)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	switch {
+	case !c.options.Validate && exists:
+		log.Info("The validating Webhook is disabled, deleting it")
+		err = c.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Delete(c.webhookName, &metav1.DeleteOptions{})
 		if errors.IsNotFound(err) {
-			klog.Infof("The Webhook %q was not found, creating it.", c.webhookName)
-			return c.createWebhook(secret)
+			return nil
 		}
 		return err
+	case !c.options.Validate:
+		return nil
+	case !exists:
+		log.Info("The validating Webhook was not found, creating it")
+		_, err = c.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Create(&admiv1beta1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: c.webhookName,
+			},
+			Webhooks: c.newValidatingWebhooks(secret),
+		})
+		return err
+	default:
+		log.Info("The validating Webhook was found, updating it")
+		webhook = webhook.DeepCopy()
+		webhook.Webhooks = c.newValidatingWebhooks(secret)
+		_, err = c.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Update(webhook)
+		return err
 	}
-	klog.Infof("The Webhook %q was found, updating it.", c.webhookName)
-	return c.updateWebhook(secret, webhook)
 }
 
 func (c *Controller) createWebhook(secret *corev1.Secret) error {
@@ -223,23 +311,65 @@ func (c *Controller) updateWebhook(secret *corev1.Secret, webhook *admiv1beta1.M
 	return err
 }
 
+// newClientConfig returns the configuration reaching the path of the Webhook Service.
+func (c *Controller) newClientConfig(secret *corev1.Secret, servicePath string) admiv1beta1.WebhookClientConfig {
+	servicePort := c.service.Port
+	return admiv1beta1.WebhookClientConfig{
+		Service: &admiv1beta1.ServiceReference{
+			Namespace: c.secretNamespace,
+			Name:      constants.ServiceName,
+			Path:      &servicePath,
+			Port:      &servicePort,
+		},
+		CABundle: certificate.GetCABundle(secret.Data),
+	}
+}
+
+// injectLabel opts a Namespace out when set to "false", and a workload in when set to "true".
+const injectLabel = "inject-node-ip"
+
+// namespaceNameLabel is set by Kubernetes 1.21+ to the name of every Namespace.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// systemNamespaces are never selected by the Webhooks intercepting all the objects of a Namespace.
+var systemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// newNamespaceSelector returns the selector excluding the Namespaces opted out of the Webhook.
+func newNamespaceSelector() *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      injectLabel,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{"false"},
+			},
+		},
+	}
+}
+
+// newUserNamespaceSelector returns the selector of newNamespaceSelector, also excluding the system
+// Namespaces and the one of the Webhook. They are excluded by name on Kubernetes 1.21+ only, the
+// older versions lacking namespaceNameLabel must label them with injectLabel=false.
+func (c *Controller) newUserNamespaceSelector() *metav1.LabelSelector {
+	selector := newNamespaceSelector()
+	excluded := append(append([]string{}, systemNamespaces...), c.secretNamespace)
+	selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      namespaceNameLabel,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   excluded,
+	})
+	return selector
+}
+
 func (c *Controller) newWebhooks(secret *corev1.Secret) []admiv1beta1.MutatingWebhook {
 	failurePolicy := admiv1beta1.Fail
-	sideEffects := admiv1beta1.SideEffectClassNone
-	servicePath := "/mutate"
-	servicePort := int32(443)
-	return []admiv1beta1.MutatingWebhook{
+	sideEffects := mutation.SideEffects
+	timeoutSeconds := int32(constants.WebhookTimeoutSeconds)
+	clientConfig := c.newClientConfig(secret, c.service.MutatePath)
+	webhooks := []admiv1beta1.MutatingWebhook{
 		{
-			Name: strings.ReplaceAll(c.webhookName, "-", "."),
-			ClientConfig: admiv1beta1.WebhookClientConfig{
-				Service: &admiv1beta1.ServiceReference{
-					Namespace: c.secretNamespace,
-					Name:      "webhook",
-					Path:      &servicePath,
-					Port:      &servicePort,
-				},
-				CABundle: certificate.GetCABundle(secret.Data),
-			},
+			Name:         strings.ReplaceAll(c.webhookName, "-", "."),
+			ClientConfig: clientConfig,
 			Rules: []admiv1beta1.RuleWithOperations{
 				{
 					Operations: []admiv1beta1.OperationType{
@@ -252,16 +382,8 @@ func (c *Controller) newWebhooks(secret *corev1.Secret) []admiv1beta1.MutatingWe
 					},
 				},
 			},
-			FailurePolicy: &failurePolicy,
-			NamespaceSelector: &metav1.LabelSelector{
-				MatchExpressions: []metav1.LabelSelectorRequirement{
-					{
-						Key:      "inject-node-ip",
-						Operator: metav1.LabelSelectorOpNotIn,
-						Values:   []string{"false"},
-					},
-				},
-			},
+			FailurePolicy:     &failurePolicy,
+			NamespaceSelector: newNamespaceSelector(),
 			ObjectSelector: &metav1.LabelSelector{
 				MatchExpressions: []metav1.LabelSelectorRequirement{
 					{
@@ -271,7 +393,99 @@ func (c *Controller) newWebhooks(secret *corev1.Secret) []admiv1beta1.MutatingWe
 					},
 				},
 			},
-			SideEffects: &sideEffects,
+			SideEffects:    &sideEffects,
+			TimeoutSeconds: &timeoutSeconds,
+		},
+	}
+	// The workloads opt in with injectLabel, so that the Webhook failing cannot block the updates of
+	// the workloads of the whole cluster, hence a dedicated entry. Their Pods are skipped by the
+	// Webhook once injected.
+	var workloadRules []admiv1beta1.RuleWithOperations
+	if c.options.MutateWorkloads {
+		workloadRules = append(workloadRules,
+			admiv1beta1.RuleWithOperations{
+				Operations: []admiv1beta1.OperationType{
+					admiv1beta1.Create,
+					admiv1beta1.Update,
+				},
+				Rule: admiv1beta1.Rule{
+					APIGroups:   []string{"apps"},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"deployments", "statefulsets", "daemonsets"},
+				},
+			},
+			admiv1beta1.RuleWithOperations{
+				Operations: []admiv1beta1.OperationType{
+					admiv1beta1.Create,
+					admiv1beta1.Update,
+				},
+				Rule: admiv1beta1.Rule{
+					APIGroups:   []string{"batch"},
+					APIVersions: []string{"v1", "v1beta1"},
+					Resources:   []string{"jobs", "cronjobs"},
+				},
+			})
+	}
+	if c.options.MutateKnative {
+		workloadRules = append(workloadRules, admiv1beta1.RuleWithOperations{
+			Operations: []admiv1beta1.OperationType{
+				admiv1beta1.Create,
+				admiv1beta1.Update,
+			},
+			Rule: admiv1beta1.Rule{
+				APIGroups:   []string{"serving.knative.dev"},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"services", "configurations"},
+			},
+		})
+	}
+	if len(workloadRules) > 0 {
+		webhooks = append(webhooks, admiv1beta1.MutatingWebhook{
+			Name:              "workloads." + strings.ReplaceAll(c.webhookName, "-", "."),
+			ClientConfig:      clientConfig,
+			Rules:             workloadRules,
+			FailurePolicy:     &failurePolicy,
+			NamespaceSelector: c.newUserNamespaceSelector(),
+			ObjectSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{injectLabel: "true"},
+			},
+			SideEffects:    &sideEffects,
+			TimeoutSeconds: &timeoutSeconds,
+		})
+	}
+	return webhooks
+}
+
+// newValidatingWebhooks returns the validating Webhook, which checks the Pods once mutated. It is
+// ignored when unavailable unless a policy is enforced, in which case the Pods would be admitted
+// without being checked.
+func (c *Controller) newValidatingWebhooks(secret *corev1.Secret) []admiv1beta1.ValidatingWebhook {
+	failurePolicy := admiv1beta1.Ignore
+	if c.options.EnforceValidation {
+		failurePolicy = admiv1beta1.Fail
+	}
+	sideEffects := admiv1beta1.SideEffectClassNone
+	timeoutSeconds := int32(constants.WebhookTimeoutSeconds)
+	return []admiv1beta1.ValidatingWebhook{
+		{
+			Name:         "validation." + strings.ReplaceAll(c.webhookName, "-", "."),
+			ClientConfig: c.newClientConfig(secret, c.service.ValidatePath),
+			Rules: []admiv1beta1.RuleWithOperations{
+				{
+					Operations: []admiv1beta1.OperationType{
+						admiv1beta1.Create,
+					},
+					Rule: admiv1beta1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods"},
+					},
+				},
+			},
+			FailurePolicy:     &failurePolicy,
+			NamespaceSelector: c.newUserNamespaceSelector(),
+			SideEffects:       &sideEffects,
+			TimeoutSeconds:    &timeoutSeconds,
 		},
 	}
 }
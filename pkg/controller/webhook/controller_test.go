@@ -7,11 +7,13 @@ import (
 
 	admiv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeinformers "k8s.io/client-go/informers"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 
 	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/certificate"
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/constants"
 )
 
 const (
@@ -97,17 +99,200 @@ func TestUpdateWebhookIfItExistsButDoesntMatchTheSecret(t *testing.T) {
 	}
 }
 
+func TestCreateWebhookWithWorkloads(t *testing.T) {
+	f := newFixture(t)
+	f.options.MutateWorkloads = true
+	f.options.MutateKnative = true
+
+	data, err := certificate.GenerateSecretData(time.Now(), time.Now().Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create the Secret: %v", err)
+	}
+	f.secrets = append(f.secrets, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: secretNamespace,
+			Name:      secretName,
+		},
+		Data: data,
+	})
+
+	c := f.run(t)
+
+	webhook, err := c.webhooksLister.Get(webhookName)
+	if err != nil {
+		t.Fatalf("Failed to get the Webhook: %v", err)
+	}
+	if len(webhook.Webhooks) != 2 {
+		t.Fatalf("Webhook.Webhooks should contain an entry for the Pods and one for the workloads: %v", webhook)
+	}
+	workloads := webhook.Webhooks[1]
+	if workloads.ObjectSelector == nil || workloads.ObjectSelector.MatchLabels[injectLabel] != "true" {
+		t.Fatalf("The workloads should opt in with the %s label: %v", injectLabel, workloads.ObjectSelector)
+	}
+	excluded := workloads.NamespaceSelector.MatchExpressions[1]
+	expectedExcluded := []string{"kube-system", "kube-public", "kube-node-lease", secretNamespace}
+	if excluded.Key != namespaceNameLabel || excluded.Operator != metav1.LabelSelectorOpNotIn || !reflect.DeepEqual(excluded.Values, expectedExcluded) {
+		t.Fatalf("The system Namespaces should be excluded: %v", workloads.NamespaceSelector)
+	}
+	var resources []string
+	for _, rule := range workloads.Rules {
+		resources = append(resources, rule.Resources...)
+	}
+	expected := []string{"deployments", "statefulsets", "daemonsets", "jobs", "cronjobs", "services", "configurations"}
+	if !reflect.DeepEqual(resources, expected) {
+		t.Fatalf("Unexpected workload resources: got %v, want %v", resources, expected)
+	}
+}
+
+func TestWebhooksUseTheServiceConfig(t *testing.T) {
+	f := newFixture(t)
+	f.options.Validate = true
+	f.service = ServiceConfig{Port: 8443, MutatePath: "/webhook/mutate", ValidatePath: "/webhook/validate"}
+
+	data, err := certificate.GenerateSecretData(time.Now(), time.Now().Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create the Secret: %v", err)
+	}
+	f.secrets = append(f.secrets, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: secretNamespace,
+			Name:      secretName,
+		},
+		Data: data,
+	})
+
+	c := f.run(t)
+
+	webhook, err := c.webhooksLister.Get(webhookName)
+	if err != nil {
+		t.Fatalf("Failed to get the Webhook: %v", err)
+	}
+	validatingWebhook, err := c.validatingWebhooksLister.Get(webhookName)
+	if err != nil {
+		t.Fatalf("Failed to get the validating Webhook: %v", err)
+	}
+	for path, service := range map[string]*admiv1beta1.ServiceReference{
+		"/webhook/mutate":   webhook.Webhooks[0].ClientConfig.Service,
+		"/webhook/validate": validatingWebhook.Webhooks[0].ClientConfig.Service,
+	} {
+		if *service.Path != path || *service.Port != 8443 || service.Name != constants.ServiceName {
+			t.Errorf("Unexpected Service: got %s:%d%s, want %s:8443%s", service.Name, *service.Port, *service.Path, constants.ServiceName, path)
+		}
+	}
+}
+
+func TestCreateValidatingWebhook(t *testing.T) {
+	f := newFixture(t)
+	f.options.Validate = true
+
+	data, err := certificate.GenerateSecretData(time.Now(), time.Now().Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create the Secret: %v", err)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: secretNamespace,
+			Name:      secretName,
+		},
+		Data: data,
+	}
+	f.secrets = append(f.secrets, secret)
+
+	c := f.run(t)
+
+	webhook, err := c.validatingWebhooksLister.Get(webhookName)
+	if err != nil {
+		t.Fatalf("Failed to get the validating Webhook: %v", err)
+	}
+	if len(webhook.Webhooks) != 1 {
+		t.Fatalf("Webhook.Webhooks should contain a single entry: %v", webhook)
+	}
+	if path := *webhook.Webhooks[0].ClientConfig.Service.Path; path != "/validate" {
+		t.Fatalf("Unexpected path: %q", path)
+	}
+	if !reflect.DeepEqual(webhook.Webhooks[0].ClientConfig.CABundle, certificate.GetCABundle(secret.Data)) {
+		t.Fatalf("The Webhook CABundle doesn't match the Secret: CABundle: %v, Secret: %v", webhook.Webhooks[0].ClientConfig.CABundle, secret)
+	}
+	if policy := *webhook.Webhooks[0].FailurePolicy; policy != admiv1beta1.Ignore {
+		t.Fatalf("The validating Webhook should be ignored when unavailable unless enforced: %s", policy)
+	}
+	if excluded := webhook.Webhooks[0].NamespaceSelector.MatchExpressions[1]; excluded.Key != namespaceNameLabel {
+		t.Fatalf("The system Namespaces should be excluded: %v", webhook.Webhooks[0].NamespaceSelector)
+	}
+}
+
+func TestCreateEnforcedValidatingWebhook(t *testing.T) {
+	f := newFixture(t)
+	f.options.Validate = true
+	f.options.EnforceValidation = true
+
+	data, err := certificate.GenerateSecretData(time.Now(), time.Now().Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create the Secret: %v", err)
+	}
+	f.secrets = append(f.secrets, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: secretNamespace,
+			Name:      secretName,
+		},
+		Data: data,
+	})
+
+	c := f.run(t)
+
+	webhook, err := c.validatingWebhooksLister.Get(webhookName)
+	if err != nil {
+		t.Fatalf("Failed to get the validating Webhook: %v", err)
+	}
+	if policy := *webhook.Webhooks[0].FailurePolicy; policy != admiv1beta1.Fail {
+		t.Fatalf("The enforced validating Webhook should fail when unavailable: %s", policy)
+	}
+}
+
+func TestDeleteValidatingWebhookIfDisabled(t *testing.T) {
+	f := newFixture(t)
+
+	data, err := certificate.GenerateSecretData(time.Now(), time.Now().Add(365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create the Secret: %v", err)
+	}
+	f.secrets = append(f.secrets, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: secretNamespace,
+			Name:      secretName,
+		},
+		Data: data,
+	})
+	f.validatingWebhooks = append(f.validatingWebhooks, &admiv1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: webhookName,
+		},
+	})
+
+	c := f.run(t)
+
+	if _, err := c.validatingWebhooksLister.Get(webhookName); !errors.IsNotFound(err) {
+		t.Fatalf("The validating Webhook should have been deleted: %v", err)
+	}
+}
+
 type fixture struct {
 	t *testing.T
 
 	kubeClient *k8sfake.Clientset
 	secrets    []*corev1.Secret
 	webhooks   []*admiv1beta1.MutatingWebhookConfiguration
+
+	validatingWebhooks []*admiv1beta1.ValidatingWebhookConfiguration
+
+	service ServiceConfig
+	options Options
 }
 
 func newFixture(t *testing.T) *fixture {
 	f := &fixture{}
 	f.t = t
+	f.service = ServiceConfig{Port: constants.ServicePort, MutatePath: constants.MutatePath, ValidatePath: constants.ValidatePath}
 	return f
 }
 
@@ -116,7 +301,7 @@ func (f *fixture) newController() (*Controller, kubeinformers.SharedInformerFact
 
 	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeClient, noResyncPeriodFunc())
 
-	c := NewController(f.kubeClient, k8sI.Core().V1().Secrets(), secretNamespace, secretName, k8sI.Admissionregistration().V1beta1().MutatingWebhookConfigurations(), webhookName)
+	c := NewController(f.kubeClient, k8sI.Core().V1().Secrets(), secretNamespace, secretName, k8sI.Admissionregistration().V1beta1().MutatingWebhookConfigurations(), k8sI.Admissionregistration().V1beta1().ValidatingWebhookConfigurations(), webhookName, f.service, f.options)
 	c.secretsSynced = alwaysReady
 
 	for _, s := range f.secrets {
@@ -125,6 +310,9 @@ func (f *fixture) newController() (*Controller, kubeinformers.SharedInformerFact
 	for _, w := range f.webhooks {
 		_, _ = f.kubeClient.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Create(w)
 	}
+	for _, w := range f.validatingWebhooks {
+		_, _ = f.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Create(w)
+	}
 
 	return c, k8sI
 }
@@ -139,7 +327,7 @@ func (f *fixture) run(t *testing.T) *Controller {
 	go func() {
 		err := c.Run(stopCh)
 		if err != nil {
-			t.Fatalf("Failed to run controller: %v", err)
+			t.Errorf("Failed to run controller: %v", err)
 		}
 	}()
 
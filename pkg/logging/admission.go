@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"encoding/json"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+// ForAdmission returns the default Logger with the fields identifying req.
+func ForAdmission(req *admissionv1beta1.AdmissionRequest) *Logger {
+	return Default().WithAdmission(req)
+}
+
+// WithAdmission returns a Logger adding the fields identifying req to the fields of l: its UID,
+// the kind, namespace and name of its object, its operation, its user and whether it is a dry run.
+// The name of an object not created yet is its generateName.
+func (l *Logger) WithAdmission(req *admissionv1beta1.AdmissionRequest) *Logger {
+	keysAndValues := []interface{}{
+		"uid", string(req.UID),
+		"kind", req.Kind.Kind,
+		"namespace", req.Namespace,
+	}
+	if name, generateName := objectName(req); name != "" {
+		keysAndValues = append(keysAndValues, "name", name)
+	} else if generateName != "" {
+		keysAndValues = append(keysAndValues, "generateName", generateName)
+	}
+	dryRun := req.DryRun != nil && *req.DryRun
+	keysAndValues = append(keysAndValues,
+		"operation", string(req.Operation),
+		"user", req.UserInfo.Username,
+		"dryRun", dryRun)
+	return l.With(keysAndValues...)
+}
+
+// objectName returns the name of the object of req, or its generateName if it has no name yet.
+func objectName(req *admissionv1beta1.AdmissionRequest) (string, string) {
+	if req.Name != "" {
+		return req.Name, ""
+	}
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+	var object struct {
+		Metadata struct {
+			Name         string `json:"name"`
+			GenerateName string `json:"generateName"`
+		} `json:"metadata"`
+	}
+	// A malformed object only leaves the name out of the fields
+	_ = json.Unmarshal(raw, &object)
+	return object.Metadata.Name, object.Metadata.GenerateName
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// LevelHandler serves the level of l: GET returns it, PUT sets it from the level query parameter,
+// e.g. PUT /loglevel?level=debug. PUT is only accepted from the loopback interface, e.g. through
+// kubectl port-forward, since the endpoint is served without authentication.
+func LevelHandler(l *Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			if !isLoopback(r.RemoteAddr) {
+				http.Error(w, "the level can only be set from localhost", http.StatusForbidden)
+				return
+			}
+			level, err := ParseLevel(r.URL.Query().Get("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if previous := l.Level(); previous != level {
+				l.SetLevel(level)
+				l.Info("Changed the log level", "level", level, "previousLevel", previous)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, fmt.Sprintf("invalid method %s, only GET and PUT are allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, l.Level())
+	})
+}
+
+// isLoopback returns true if the address host:port is a loopback address.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+
+	"k8s.io/klog"
+)
+
+// RedirectKlog writes the lines of klog, used by the Kubernetes client, with l rather than to
+// stderr.
+func RedirectKlog(l *Logger) {
+	flags := flag.NewFlagSet("klog", flag.PanicOnError)
+	klog.InitFlags(flags)
+	// klog writes the lines of a severity to its output and to the outputs of the lower severities,
+	// only the output of the lowest one is kept to write each line once
+	_ = flags.Set("logtostderr", "false")
+	_ = flags.Set("stderrthreshold", "FATAL")
+	for _, severity := range []string{"FATAL", "ERROR", "WARNING"} {
+		klog.SetOutputBySeverity(severity, ioutil.Discard)
+	}
+	klog.SetOutputBySeverity("INFO", klogWriter{l.With("logger", "klog")})
+}
+
+// klogWriter parses the lines of klog, e.g. "E1018 12:00:00.000000  1 reflector.go:123] message".
+type klogWriter struct {
+	logger *Logger
+}
+
+func (w klogWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\n")
+	level := InfoLevel
+	if len(line) > 0 {
+		switch line[0] {
+		case 'W':
+			level = WarnLevel
+		case 'E', 'F':
+			level = ErrorLevel
+		}
+	}
+	var keysAndValues []interface{}
+	if i := bytes.Index(line, []byte("] ")); i >= 0 {
+		if header := bytes.Fields(line[:i]); len(header) > 0 {
+			keysAndValues = append(keysAndValues, "caller", string(header[len(header)-1]))
+		}
+		line = line[i+2:]
+	}
+	w.logger.log(level, string(line), keysAndValues)
+	return len(p), nil
+}
@@ -0,0 +1,195 @@
+// Package logging implements the structured logger of the binaries, which writes one JSON object
+// per line. The level is shared by a Logger and the Loggers derived from it, and can be changed at
+// runtime through LevelHandler.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("Level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level named s: debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// exit terminates the process after a Fatal line, replaced by the tests.
+var exit = os.Exit
+
+// Logger writes structured log lines carrying its fields. It is safe for concurrent use. A nil
+// Logger writes to Default().
+type Logger struct {
+	sink *sink
+	// fields are the key-value pairs added to every line.
+	fields []interface{}
+}
+
+// sink is the output and the level shared by a Logger and the Loggers derived from it.
+type sink struct {
+	level int32
+	now   func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New returns a Logger writing the lines at or above level to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{sink: &sink{level: int32(level), now: time.Now, w: w}}
+}
+
+var std = New(os.Stderr, InfoLevel)
+
+// Default returns the Logger of the process, writing to stderr unless replaced by SetDefault.
+func Default() *Logger {
+	return std
+}
+
+// SetDefault replaces the Logger of the process. It must be called before the Logger is used,
+// typically at the start of main.
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// orDefault returns l, or Default() if l is nil.
+func (l *Logger) orDefault() *Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
+
+// With returns a Logger adding the key-value pairs keysAndValues to the fields of l.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	l = l.orDefault()
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keysAndValues...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Level returns the minimum level of the lines written.
+func (l *Logger) Level() Level {
+	l = l.orDefault()
+	return Level(atomic.LoadInt32(&l.sink.level))
+}
+
+// SetLevel sets the minimum level of the lines written by l and the Loggers sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	l = l.orDefault()
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+// Enabled returns whether the lines of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Debug writes msg and the key-value pairs keysAndValues at the debug level.
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(DebugLevel, msg, keysAndValues)
+}
+
+// Info writes msg and the key-value pairs keysAndValues at the info level.
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(InfoLevel, msg, keysAndValues)
+}
+
+// Warn writes msg and the key-value pairs keysAndValues at the warn level.
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(WarnLevel, msg, keysAndValues)
+}
+
+// Error writes msg and the key-value pairs keysAndValues at the error level.
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(ErrorLevel, msg, keysAndValues)
+}
+
+// Fatal writes msg and the key-value pairs keysAndValues at the error level, then exits.
+func (l *Logger) Fatal(msg string, keysAndValues ...interface{}) {
+	l.log(ErrorLevel, msg, keysAndValues)
+	exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	l = l.orDefault()
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeValue(&b, l.sink.now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeValue(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeValue(&b, msg)
+	writeFields(&b, l.fields)
+	writeFields(&b, keysAndValues)
+	b.WriteString("}\n")
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	_, _ = l.sink.w.Write(b.Bytes())
+}
+
+// writeFields writes the key-value pairs keysAndValues as members of a JSON object. A value
+// without a key is written under the key "extra".
+func writeFields(b *bytes.Buffer, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, value := "extra", keysAndValues[i]
+		if i+1 < len(keysAndValues) {
+			key, value = fmt.Sprint(keysAndValues[i]), keysAndValues[i+1]
+		}
+		b.WriteByte(',')
+		writeValue(b, key)
+		b.WriteByte(':')
+		writeValue(b, value)
+	}
+}
+
+// writeValue writes value in JSON. The errors and the Stringers are written as strings.
+func writeValue(b *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	b.Write(data)
+}
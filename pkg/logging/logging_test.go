@@ -0,0 +1,223 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// newTestLogger returns a Logger writing to the returned buffer at a fixed time.
+func newTestLogger(level Level) (*Logger, *bytes.Buffer) {
+	var b bytes.Buffer
+	l := New(&b, level)
+	l.sink.now = func() time.Time { return time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &b
+}
+
+// decodeLines returns the JSON objects written to b, one per line.
+func decodeLines(t *testing.T, b *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("The line %q is not a JSON object: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestLogger(t *testing.T) {
+	l, b := newTestLogger(InfoLevel)
+	l.With("controller", "secret").Info("Reconciled", "attempt", 2, "error", errors.New("boom"), "expiresIn", time.Minute, "dangling")
+
+	expected := `{"time":"2020-04-01T12:00:00Z","level":"info","msg":"Reconciled","controller":"secret","attempt":2,"error":"boom","expiresIn":"1m0s","extra":"dangling"}` + "\n"
+	if b.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nwant:\n%s", b.String(), expected)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	l, b := newTestLogger(WarnLevel)
+	derived := l.With("key", "value")
+	derived.Info("Dropped")
+	derived.Warn("Written")
+	// The level is shared with the derived Loggers
+	l.SetLevel(DebugLevel)
+	derived.Debug("Written too")
+
+	lines := decodeLines(t, b)
+	if len(lines) != 2 || lines[0]["msg"] != "Written" || lines[1]["msg"] != "Written too" || lines[1]["level"] != "debug" {
+		t.Fatalf("Unexpected lines: %v", lines)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	l, b := newTestLogger(InfoLevel)
+	previous := Default()
+	SetDefault(l)
+	t.Cleanup(func() { SetDefault(previous) })
+
+	var nilLogger *Logger
+	nilLogger.Info("Written")
+	nilLogger.With("key", "value").Debug("Dropped")
+
+	lines := decodeLines(t, b)
+	if len(lines) != 1 || lines[0]["msg"] != "Written" {
+		t.Fatalf("A nil Logger should write to the default one: %v", lines)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{DebugLevel, InfoLevel, WarnLevel, ErrorLevel} {
+		if parsed, err := ParseLevel(strings.ToUpper(level.String())); err != nil || parsed != level {
+			t.Errorf("Failed to parse %s: got %v, %v", level, parsed, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("An unknown level should be rejected")
+	}
+}
+
+func TestFatal(t *testing.T) {
+	code := -1
+	exit = func(c int) { code = c }
+	t.Cleanup(func() { exit = os.Exit })
+
+	l, b := newTestLogger(InfoLevel)
+	l.Fatal("Failed", "error", "boom")
+	if code != 1 {
+		t.Fatalf("Fatal should exit with 1, got %d", code)
+	}
+	if lines := decodeLines(t, b); len(lines) != 1 || lines[0]["level"] != "error" {
+		t.Fatalf("Unexpected lines: %v", lines)
+	}
+}
+
+func TestWithAdmission(t *testing.T) {
+	dryRun := true
+	tests := []struct {
+		name     string
+		req      *admiv1beta1.AdmissionRequest
+		expected map[string]interface{}
+	}{{
+		name: "named",
+		req: &admiv1beta1.AdmissionRequest{
+			UID:       "1234",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Namespace: "default",
+			Name:      "api",
+			Operation: admiv1beta1.Update,
+			UserInfo:  authenticationv1.UserInfo{Username: "alice"},
+			DryRun:    &dryRun,
+		},
+		expected: map[string]interface{}{
+			"uid": "1234", "kind": "Deployment", "namespace": "default", "name": "api",
+			"operation": "UPDATE", "user": "alice", "dryRun": true,
+		},
+	}, {
+		name: "generated name",
+		req: &admiv1beta1.AdmissionRequest{
+			UID:       "5678",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: admiv1beta1.Create,
+			UserInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"},
+			Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"generateName":"api-7d9f8-"}}`)},
+		},
+		expected: map[string]interface{}{
+			"uid": "5678", "kind": "Pod", "namespace": "default", "generateName": "api-7d9f8-",
+			"operation": "CREATE", "user": "system:serviceaccount:kube-system:replicaset-controller", "dryRun": false,
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, b := newTestLogger(InfoLevel)
+			l.WithAdmission(test.req).Info("Admitted")
+			fields := decodeLines(t, b)[0]
+			for _, key := range []string{"time", "level", "msg"} {
+				delete(fields, key)
+			}
+			if !reflect.DeepEqual(fields, test.expected) {
+				t.Fatalf("Unexpected fields: got %v, want %v", fields, test.expected)
+			}
+		})
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	l, _ := newTestLogger(InfoLevel)
+	h := LevelHandler(l)
+
+	// newRequest returns a request from the loopback interface
+	newRequest := func(method, target string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = "127.0.0.1:41234"
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodPut, "/loglevel?level=debug"))
+	if w.Code != http.StatusOK || l.Level() != DebugLevel {
+		t.Fatalf("Failed to set the level: %d %s, level %s", w.Code, w.Body, l.Level())
+	}
+
+	// The level is readable, but not settable, from another host
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/loglevel", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "debug\n" {
+		t.Fatalf("Unexpected level: %d %q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/loglevel?level=error", nil))
+	if w.Code != http.StatusForbidden || l.Level() != DebugLevel {
+		t.Fatalf("The level should only be settable from localhost: %d, level %s", w.Code, l.Level())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodPut, "/loglevel?level=verbose"))
+	if w.Code != http.StatusBadRequest || l.Level() != DebugLevel {
+		t.Fatalf("An unknown level should be rejected: %d, level %s", w.Code, l.Level())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/loglevel", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+}
+
+func TestKlogWriter(t *testing.T) {
+	l, b := newTestLogger(InfoLevel)
+	w := klogWriter{l}
+	_, _ = w.Write([]byte("E0401 12:00:00.000000       1 reflector.go:123] Failed to list *v1.Namespace: forbidden\n"))
+	_, _ = w.Write([]byte("no header\n"))
+
+	lines := decodeLines(t, b)
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected lines: %v", lines)
+	}
+	if lines[0]["level"] != "error" || lines[0]["msg"] != "Failed to list *v1.Namespace: forbidden" || lines[0]["caller"] != "reflector.go:123" {
+		t.Errorf("Unexpected line: %v", lines[0])
+	}
+	if lines[1]["level"] != "info" || lines[1]["msg"] != "no header" {
+		t.Errorf("Unexpected line: %v", lines[1])
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "The number of requests.", "webhook", "dry_run")
+	c.Inc("mutate", "false")
+	c.Inc("mutate", "false")
+	c.Add(3, "validate", "true")
+	r.NewCounterVec("errors_total", "The number of \"errors\".")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Failed to write the metrics: %v", err)
+	}
+	expected := `# HELP requests_total The number of requests.
+# TYPE requests_total counter
+requests_total{webhook="mutate",dry_run="false"} 2
+requests_total{webhook="validate",dry_run="true"} 3
+# HELP errors_total The number of "errors".
+# TYPE errors_total counter
+`
+	if b.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nwant:\n%s", b.String(), expected)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("duration_seconds", "The duration.", []float64{0.1, 1}, "webhook")
+	h.Observe(0.05, "mutate")
+	h.Observe(0.5, "mutate")
+	h.Observe(5, "mutate")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Failed to write the metrics: %v", err)
+	}
+	expected := `# HELP duration_seconds The duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{webhook="mutate",le="0.1"} 1
+duration_seconds_bucket{webhook="mutate",le="1"} 2
+duration_seconds_bucket{webhook="mutate",le="+Inf"} 3
+duration_seconds_sum{webhook="mutate"} 5.55
+duration_seconds_count{webhook="mutate"} 3
+`
+	if b.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nwant:\n%s", b.String(), expected)
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("total", "Total.", "value").Inc("a\"b\\c\nd")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := "# HELP total Total.\n# TYPE total counter\ntotal{value=\"a\\\"b\\\\c\\nd\"} 1\n"
+	if w.Body.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nwant:\n%s", w.Body.String(), expected)
+	}
+}
+
+func TestWrongNumberOfLabelValues(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("A wrong number of label values should panic")
+		}
+	}()
+	NewRegistry().NewCounterVec("total", "Total.", "a", "b").Inc("a")
+}
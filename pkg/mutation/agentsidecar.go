@@ -0,0 +1,155 @@
+package mutation
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// agentSidecarContainerName is the name of the injected Agent container. A Pod already containing a
+// container with this name is considered as already running its own Agent.
+const agentSidecarContainerName = "datadog-agent"
+
+// AgentSidecarConfig configures the Agent injected as a sidecar in the Pods scheduled on Nodes
+// without a node-local Agent, such as virtual-kubelet or serverless Node pools.
+type AgentSidecarConfig struct {
+	// Selectors match the Pods targeting such Nodes, a Pod is matched by any of them.
+	Selectors []NodePoolSelector `json:"selectors"`
+	// Image is the image of the Agent container.
+	Image string `json:"image"`
+	// Resources are the resources of the Agent container.
+	Resources corev1.ResourceRequirements `json:"resources"`
+	// APIKeySecret references the key of the Secret containing the Datadog API key.
+	APIKeySecret corev1.SecretKeySelector `json:"apiKeySecret"`
+	// Env are additional environment variables of the Agent container.
+	Env []corev1.EnvVar `json:"env"`
+}
+
+// NodePoolSelector matches the Pods targeting a Node pool, through their nodeSelector, their
+// node affinity or their tolerations. All the criteria set must match.
+type NodePoolSelector struct {
+	// NodeLabels match the Pods requiring Nodes with all these labels, via their nodeSelector
+	// or via each of the terms of their required node affinity.
+	NodeLabels map[string]string `json:"nodeLabels"`
+	// TolerationKey matches the Pods tolerating the taints with this key.
+	TolerationKey string `json:"tolerationKey"`
+}
+
+// validate returns an error if the configuration is incomplete. An empty configuration is valid,
+// the sidecar mode is then unavailable.
+func (c *AgentSidecarConfig) validate() error {
+	for i, selector := range c.Selectors {
+		if len(selector.NodeLabels) == 0 && selector.TolerationKey == "" {
+			return fmt.Errorf("selector %d matches every Pod, it must set nodeLabels or tolerationKey", i)
+		}
+	}
+	if len(c.Selectors) == 0 && c.Image == "" && c.APIKeySecret.Name == "" && c.APIKeySecret.Key == "" {
+		return nil
+	}
+	if c.Image == "" {
+		return fmt.Errorf("the image must be set")
+	}
+	if c.APIKeySecret.Name == "" || c.APIKeySecret.Key == "" {
+		return fmt.Errorf("the name and key of the API key Secret must be set")
+	}
+	return nil
+}
+
+// isConfigured returns true if the Agent sidecar can be injected.
+func (c *AgentSidecarConfig) isConfigured() bool {
+	return c.Image != "" && c.APIKeySecret.Name != "" && c.APIKeySecret.Key != ""
+}
+
+// targets returns true if the Pod spec targets a Node pool matched by one of the selectors.
+func (c *AgentSidecarConfig) targets(spec *corev1.PodSpec) bool {
+	for _, selector := range c.Selectors {
+		if selector.matches(spec) {
+			return true
+		}
+	}
+	return false
+}
+
+// container returns the Agent container.
+func (c *AgentSidecarConfig) container() corev1.Container {
+	apiKey := c.APIKeySecret
+	env := []corev1.EnvVar{
+		{
+			Name:      "DD_API_KEY",
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &apiKey},
+		},
+		fieldRefEnvVar("DD_KUBERNETES_KUBELET_NODENAME", "spec.nodeName"),
+	}
+	return corev1.Container{
+		Name:      agentSidecarContainerName,
+		Image:     c.Image,
+		Env:       mergeEnvVars(c.Env, env),
+		Resources: c.Resources,
+	}
+}
+
+// matches returns true if the Pod spec satisfies all the criteria of the selector.
+func (s *NodePoolSelector) matches(spec *corev1.PodSpec) bool {
+	if len(s.NodeLabels) > 0 && !requiresNodeLabels(spec, s.NodeLabels) {
+		return false
+	}
+	if s.TolerationKey != "" && !toleratesKey(spec.Tolerations, s.TolerationKey) {
+		return false
+	}
+	return true
+}
+
+// requiresNodeLabels returns true if the Pod spec can only be scheduled on Nodes with the labels.
+func requiresNodeLabels(spec *corev1.PodSpec, labels map[string]string) bool {
+	for key, value := range labels {
+		if spec.NodeSelector[key] == value {
+			continue
+		}
+		if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil ||
+			spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+			return false
+		}
+		// The terms are ORed, each of them must require the label
+		terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if len(terms) == 0 {
+			return false
+		}
+		for _, term := range terms {
+			if !termRequiresNodeLabel(term, key, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// termRequiresNodeLabel returns true if the node selector term only matches Nodes with the label key=value.
+func termRequiresNodeLabel(term corev1.NodeSelectorTerm, key, value string) bool {
+	for _, requirement := range term.MatchExpressions {
+		if requirement.Key == key && requirement.Operator == corev1.NodeSelectorOpIn &&
+			len(requirement.Values) == 1 && requirement.Values[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// toleratesKey returns true if one of the tolerations explicitly tolerates the taints with the key.
+func toleratesKey(tolerations []corev1.Toleration, key string) bool {
+	for _, toleration := range tolerations {
+		if toleration.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// hasContainer returns true if containers contains a container named name.
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, container := range containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package mutation
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNodePoolSelector(t *testing.T) {
+	selector := NodePoolSelector{
+		NodeLabels:    map[string]string{"type": "virtual-kubelet"},
+		TolerationKey: "virtual-kubelet.io/provider",
+	}
+	toleration := corev1.Toleration{Key: "virtual-kubelet.io/provider", Operator: corev1.TolerationOpExists}
+	term := func(key, value string) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{
+			Key: key, Operator: corev1.NodeSelectorOpIn, Values: []string{value},
+		}}}
+	}
+	affinity := func(terms ...corev1.NodeSelectorTerm) *corev1.Affinity {
+		return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		spec    corev1.PodSpec
+		matches bool
+	}{{
+		name: "no constraint",
+	}, {
+		name: "node selector and toleration",
+		spec: corev1.PodSpec{
+			NodeSelector: map[string]string{"type": "virtual-kubelet"},
+			Tolerations:  []corev1.Toleration{toleration},
+		},
+		matches: true,
+	}, {
+		name:    "node affinity and toleration",
+		spec:    corev1.PodSpec{Affinity: affinity(term("type", "virtual-kubelet")), Tolerations: []corev1.Toleration{toleration}},
+		matches: true,
+	}, {
+		name: "node affinity with a term allowing other nodes",
+		spec: corev1.PodSpec{
+			Affinity:    affinity(term("type", "virtual-kubelet"), term("zone", "a")),
+			Tolerations: []corev1.Toleration{toleration},
+		},
+	}, {
+		name: "toleration only",
+		spec: corev1.PodSpec{Tolerations: []corev1.Toleration{toleration}},
+	}, {
+		name: "node selector only",
+		spec: corev1.PodSpec{NodeSelector: map[string]string{"type": "virtual-kubelet"}},
+	}, {
+		name: "other node selector value",
+		spec: corev1.PodSpec{
+			NodeSelector: map[string]string{"type": "regular"},
+			Tolerations:  []corev1.Toleration{toleration},
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matches := selector.matches(&test.spec); matches != test.matches {
+				t.Fatalf("Unexpected match: got %t, want %t", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestAgentSidecarConfigValidate(t *testing.T) {
+	apiKeySecret := corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "datadog"}, Key: "api-key"}
+	selectors := []NodePoolSelector{{NodeLabels: map[string]string{"type": "virtual-kubelet"}}}
+
+	tests := []struct {
+		name       string
+		config     AgentSidecarConfig
+		valid      bool
+		configured bool
+	}{{
+		name:  "empty",
+		valid: true,
+	}, {
+		name:       "without selectors",
+		config:     AgentSidecarConfig{Image: "datadog/agent:7", APIKeySecret: apiKeySecret},
+		valid:      true,
+		configured: true,
+	}, {
+		name:       "with selectors",
+		config:     AgentSidecarConfig{Selectors: selectors, Image: "datadog/agent:7", APIKeySecret: apiKeySecret},
+		valid:      true,
+		configured: true,
+	}, {
+		name:   "image only",
+		config: AgentSidecarConfig{Image: "datadog/agent:7"},
+	}, {
+		name:   "Secret without key",
+		config: AgentSidecarConfig{Image: "datadog/agent:7", APIKeySecret: corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "datadog"}}},
+	}, {
+		name:   "Secret only",
+		config: AgentSidecarConfig{APIKeySecret: apiKeySecret},
+	}, {
+		name:   "selectors only",
+		config: AgentSidecarConfig{Selectors: selectors},
+	}, {
+		name:       "selector matching every Pod",
+		config:     AgentSidecarConfig{Selectors: []NodePoolSelector{{}}, Image: "datadog/agent:7", APIKeySecret: apiKeySecret},
+		configured: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.config.validate(); test.valid != (err == nil) {
+				t.Errorf("Unexpected validation: %v", err)
+			}
+			if configured := test.config.isConfigured(); configured != test.configured {
+				t.Errorf("Unexpected isConfigured: got %t, want %t", configured, test.configured)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package mutation
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// apmLibraryAnnotation selects the tracing library injected in the Pod, as <language>:<version>.
+	apmLibraryAnnotation = "node-ip-webhook/apm-library"
+
+	// apmLibraryMountPath is where the library is copied by the init container and read by the containers.
+	apmLibraryMountPath = "/datadog-lib"
+	// apmLibraryVolumeName is the name of the emptyDir volume shared with the init container, suffixed if already taken.
+	apmLibraryVolumeName = "datadog-lib"
+	// apmLibraryInitContainerName is the name of the init container copying the library, suffixed if already taken.
+	apmLibraryInitContainerName = "datadog-lib-init"
+
+	defaultAPMLibraryRegistry = "gcr.io/datadoghq"
+)
+
+// apmLibraryVersionPattern matches the valid image tags.
+var apmLibraryVersionPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// apmLanguage describes how the tracing library of a language is injected.
+type apmLanguage struct {
+	// image is the name, in the registry, of the image containing the library.
+	image string
+	// preloadEnvVarName is the environment variable making the runtime load the library.
+	preloadEnvVarName string
+	// preloadValue is appended to the value of the preload variable.
+	preloadValue string
+	// separator separates preloadValue from the existing value of the preload variable.
+	separator string
+}
+
+// apmLanguages are the supported languages.
+var apmLanguages = map[string]apmLanguage{
+	"java": {
+		image:             "dd-lib-java-init",
+		preloadEnvVarName: "JAVA_TOOL_OPTIONS",
+		preloadValue:      "-javaagent:" + apmLibraryMountPath + "/dd-java-agent.jar",
+		separator:         " ",
+	},
+	"js": {
+		image:             "dd-lib-js-init",
+		preloadEnvVarName: "NODE_OPTIONS",
+		preloadValue:      "--require=" + apmLibraryMountPath + "/node_modules/dd-trace/init",
+		separator:         " ",
+	},
+	"python": {
+		image:             "dd-lib-python-init",
+		preloadEnvVarName: "PYTHONPATH",
+		preloadValue:      apmLibraryMountPath + "/",
+		separator:         ":",
+	},
+}
+
+// APMLibrariesConfig configures the injection of the tracing libraries.
+type APMLibrariesConfig struct {
+	// Registry is the registry of the library images, gcr.io/datadoghq by default.
+	Registry string `json:"registry"`
+}
+
+// apmLibrary is a tracing library selected by apmLibraryAnnotation.
+type apmLibrary struct {
+	apmLanguage
+
+	version string
+}
+
+// parseAPMLibrary returns the library described by s, formatted as <language>:<version>.
+func parseAPMLibrary(s string) (*apmLibrary, error) {
+	parts := strings.SplitN(s, ":", 2)
+	language, ok := apmLanguages[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown language %q, must be one of %q", parts[0], apmLanguageNames())
+	}
+	if len(parts) != 2 || !apmLibraryVersionPattern.MatchString(parts[1]) {
+		return nil, fmt.Errorf("invalid library %q, must be formatted as <language>:<version>", s)
+	}
+	return &apmLibrary{apmLanguage: language, version: parts[1]}, nil
+}
+
+// apmLanguageNames returns the sorted names of the supported languages.
+func apmLanguageNames() []string {
+	names := make([]string, 0, len(apmLanguages))
+	for name := range apmLanguages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// initContainer returns the init container copying the library into the volume.
+func (l *apmLibrary) initContainer(c *APMLibrariesConfig, name, volumeName string) corev1.Container {
+	registry := c.Registry
+	if registry == "" {
+		registry = defaultAPMLibraryRegistry
+	}
+	return corev1.Container{
+		Name:         name,
+		Image:        registry + "/" + l.image + ":" + l.version,
+		Command:      []string{"sh", "copy-lib.sh", apmLibraryMountPath},
+		VolumeMounts: []corev1.VolumeMount{{Name: volumeName, MountPath: apmLibraryMountPath}},
+	}
+}
+
+// preloadEnvVar returns the preload variable of the container: preloadValue appended to the literal
+// value of its existing entry, located at index, or a new entry if index is negative.
+// ok is false if the existing entry must be left untouched, which is the case of an entry set
+// from a source since nothing can be appended to it.
+func (l *apmLibrary) preloadEnvVar(container corev1.Container) (envVar corev1.EnvVar, index int, ok bool) {
+	for i, existing := range container.Env {
+		if existing.Name != l.preloadEnvVarName {
+			continue
+		}
+		switch {
+		case existing.ValueFrom != nil, strings.Contains(existing.Value, l.preloadValue):
+			return corev1.EnvVar{}, 0, false
+		case existing.Value == "":
+			return corev1.EnvVar{Name: existing.Name, Value: l.preloadValue}, i, true
+		default:
+			return corev1.EnvVar{Name: existing.Name, Value: existing.Value + l.separator + l.preloadValue}, i, true
+		}
+	}
+	return corev1.EnvVar{Name: l.preloadEnvVarName, Value: l.preloadValue}, -1, true
+}
+
+// apmLibraryVolume returns the name of the volume containing the library in the Pod spec and the
+// index of the init container copying the library into it, or -1 if both must be added. The init
+// container already copying a library, e.g. when the template of a workload is updated, and its
+// volume are reused.
+func apmLibraryVolume(spec *corev1.PodSpec) (string, int) {
+	for i, container := range spec.InitContainers {
+		for _, volumeMount := range container.VolumeMounts {
+			if volumeMount.MountPath == apmLibraryMountPath {
+				return volumeMount.Name, i
+			}
+		}
+	}
+
+	names := make(map[string]bool, len(spec.Volumes))
+	for _, volume := range spec.Volumes {
+		names[volume.Name] = true
+	}
+	return uniqueName(apmLibraryVolumeName, names), -1
+}
+
+// apmLibraryInitContainerNameFor returns the name of the init container added to the Pod spec.
+func apmLibraryInitContainerNameFor(spec *corev1.PodSpec) string {
+	names := make(map[string]bool, len(spec.InitContainers))
+	for _, container := range spec.InitContainers {
+		names[container.Name] = true
+	}
+	return uniqueName(apmLibraryInitContainerName, names)
+}
+
+// uniqueName returns name, suffixed if it is already taken.
+func uniqueName(name string, taken map[string]bool) string {
+	unique := name
+	for i := 1; taken[unique]; i++ {
+		unique = name + "-" + strconv.Itoa(i)
+	}
+	return unique
+}
+
+// apmLibraryMutator injects the tracing library selected by apmLibraryAnnotation.
+type apmLibraryMutator struct {
+	sidecars     *sidecarDetector
+	apmLibraries *APMLibrariesConfig
+}
+
+// Name implements Mutator.
+func (m *apmLibraryMutator) Name() string {
+	return "apm-library"
+}
+
+// Mutate implements Mutator.
+func (m *apmLibraryMutator) Mutate(req *Request) (*Result, error) {
+	template := req.Template
+	value, ok := template.Annotations[apmLibraryAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	library, err := parseAPMLibrary(value)
+	if err != nil {
+		return nil, deny("invalid annotation %q: %w", apmLibraryAnnotation, err)
+	}
+
+	var patch patchBuilder
+	var warnings []string
+	var volumeName string
+	for i, container := range template.Spec.Containers {
+		if m.sidecars.detect(template, container) != "" {
+			continue
+		}
+
+		if volumeName == "" {
+			var initContainer int
+			volumeName, initContainer = apmLibraryVolume(&template.Spec)
+			if initContainer < 0 {
+				patch.addVolume(template.SpecPath(), template.Spec.Volumes, corev1.Volume{
+					Name:         volumeName,
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				})
+				patch.addInitContainer(template.SpecPath(), template.Spec.InitContainers, library.initContainer(
+					m.apmLibraries, apmLibraryInitContainerNameFor(&template.Spec), volumeName))
+			} else if image := library.initContainer(m.apmLibraries, "", volumeName).Image; template.Spec.InitContainers[initContainer].Image != image {
+				// The annotation of the workload selects another version of the library
+				patch.add(fmt.Sprintf("%s/initContainers/%d/image", template.SpecPath(), initContainer), image)
+			}
+		}
+		if !hasVolumeMount(container.VolumeMounts, apmLibraryMountPath) {
+			patch.addVolumeMount(template.ContainerPath(i), container.VolumeMounts, corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: apmLibraryMountPath,
+			})
+		}
+
+		preload, index, ok := library.preloadEnvVar(container)
+		switch {
+		case !ok:
+			if hasEnvVarFromSource(container.Env, library.preloadEnvVarName) {
+				warnings = append(warnings, fmt.Sprintf("container %q sets %q from a source, the APM library can't be appended to it", container.Name, library.preloadEnvVarName))
+			}
+		case index < 0:
+			patch.addEnvVars(template.ContainerPath(i), container.Env, []corev1.EnvVar{preload})
+		default:
+			// An empty value is omitted from the object, "replace" requires it to exist while "add"
+			// also overwrites it
+			patch.add(fmt.Sprintf("%s/env/%d/value", template.ContainerPath(i), index), preload.Value)
+		}
+	}
+	return &Result{Patch: patch.operations, Warnings: warnings}, nil
+}
+
+// hasEnvVarFromSource returns true if envVars contains an entry named name set from a source.
+func hasEnvVarFromSource(envVars []corev1.EnvVar, name string) bool {
+	for _, env := range envVars {
+		if env.Name == name && env.ValueFrom != nil {
+			return true
+		}
+	}
+	return false
+}
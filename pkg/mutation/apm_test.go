@@ -0,0 +1,37 @@
+package mutation
+
+import "testing"
+
+func TestParseAPMLibrary(t *testing.T) {
+	tests := []struct {
+		value   string
+		version string
+		valid   bool
+	}{
+		{value: "java:v1.20.0", version: "v1.20.0", valid: true},
+		{value: "js:latest", version: "latest", valid: true},
+		{value: "python:v1", version: "v1", valid: true},
+		{value: "java"},
+		{value: "java:"},
+		{value: "java:v1 --privileged"},
+		{value: "cobol:v1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			library, err := parseAPMLibrary(test.value)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("%q should be rejected", test.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", test.value, err)
+			}
+			if library.version != test.version {
+				t.Fatalf("Unexpected version: got %q, want %q", library.version, test.version)
+			}
+		})
+	}
+}
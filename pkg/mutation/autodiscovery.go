@@ -0,0 +1,126 @@
+package mutation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// autodiscoveryAnnotationPrefix prefixes the annotations configuring the Agent autodiscovery of a
+// container, named ad.datadoghq.com/<container>.<suffix>.
+const autodiscoveryAnnotationPrefix = "ad.datadoghq.com/"
+
+// AutodiscoveryConfig configures the autodiscovery annotations added by default.
+type AutodiscoveryConfig struct {
+	// Annotations maps the suffix of the annotations, e.g. logs, to the template of their value.
+	// The templates are executed against templateData, an empty result adds no annotation.
+	Annotations map[string]string `json:"annotations"`
+}
+
+// autodiscoveryTemplate renders the autodiscovery annotation ending with suffix.
+type autodiscoveryTemplate struct {
+	suffix   string
+	template *valueTemplate
+}
+
+// autodiscovery renders the default autodiscovery annotations of the containers.
+type autodiscovery struct {
+	// templates are sorted by suffix so that the patches are deterministic.
+	templates []autodiscoveryTemplate
+}
+
+// newAutodiscovery returns an autodiscovery rendering the configured annotations.
+func newAutodiscovery(c AutodiscoveryConfig) (*autodiscovery, error) {
+	a := &autodiscovery{}
+	for suffix, text := range c.Annotations {
+		if errs := validation.IsQualifiedName(autodiscoveryAnnotation("container", suffix)); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid annotation suffix %q: %s", suffix, strings.Join(errs, ", "))
+		}
+		t, err := parseValueTemplate(suffix, text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %q: %w", suffix, err)
+		}
+		a.templates = append(a.templates, autodiscoveryTemplate{suffix: suffix, template: t})
+	}
+	sort.Slice(a.templates, func(i, j int) bool { return a.templates[i].suffix < a.templates[j].suffix })
+	return a, nil
+}
+
+// checkKeys returns an error if the autodiscovery annotations of the container are not valid
+// keys, e.g. because the container is unnamed or its name is too long.
+func (a *autodiscovery) checkKeys(container string) error {
+	for _, t := range a.templates {
+		key := autodiscoveryAnnotation(container, t.suffix)
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// annotations returns the autodiscovery annotations of the container, excluding the ones
+// already set on the template.
+func (a *autodiscovery) annotations(template *PodTemplate, namespace string, container corev1.Container) (map[string]string, error) {
+	data := newTemplateData(template, namespace, container)
+	annotations := make(map[string]string)
+	for _, t := range a.templates {
+		key := autodiscoveryAnnotation(container.Name, t.suffix)
+		if _, ok := template.Annotations[key]; ok {
+			continue
+		}
+		value, err := t.template.execute(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render the annotation %q: %w", key, err)
+		}
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	return annotations, nil
+}
+
+// autodiscoveryAnnotation returns the key of the autodiscovery annotation of the container ending with suffix.
+func autodiscoveryAnnotation(container, suffix string) string {
+	return autodiscoveryAnnotationPrefix + container + "." + suffix
+}
+
+// autodiscoveryMutator adds the default autodiscovery annotations of the containers.
+type autodiscoveryMutator struct {
+	sidecars      *sidecarDetector
+	autodiscovery *autodiscovery
+}
+
+// Name implements Mutator.
+func (m *autodiscoveryMutator) Name() string {
+	return "autodiscovery"
+}
+
+// Mutate implements Mutator.
+func (m *autodiscoveryMutator) Mutate(req *Request) (*Result, error) {
+	template := req.Template
+	annotations := make(map[string]string)
+	var warnings []string
+	for _, container := range template.Spec.Containers {
+		if m.sidecars.detect(template, container) != "" {
+			continue
+		}
+		if err := m.autodiscovery.checkKeys(container.Name); err != nil {
+			warnings = append(warnings, fmt.Sprintf("container %q skipped: %v", container.Name, err))
+			continue
+		}
+		containerAnnotations, err := m.autodiscovery.annotations(template, req.Admission.Namespace, container)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range containerAnnotations {
+			annotations[key] = value
+		}
+	}
+
+	var patch patchBuilder
+	patch.addAnnotations(template.MetadataPath(), template.HasMetadata, template.Annotations, annotations)
+	return &Result{Patch: patch.operations, Warnings: warnings}, nil
+}
@@ -0,0 +1,124 @@
+package mutation
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// Config configures the built-in Mutators, it is part of the configuration file of the Webhook.
+type Config struct {
+	// Sidecars lists the containers, on top of the well-known ones, that must not be mutated.
+	Sidecars SidecarConfig `json:"sidecars"`
+	// AgentSidecar configures the Agent injected in the Pods scheduled on Nodes without a node-local Agent.
+	AgentSidecar AgentSidecarConfig `json:"agentSidecar"`
+	// AgentService is the Service targeted by the service injection mode.
+	AgentService AgentServiceConfig `json:"agentService"`
+	// APMLibraries configures the injection of the tracing libraries.
+	APMLibraries APMLibrariesConfig `json:"apmLibraries"`
+	// Autodiscovery configures the autodiscovery annotations added to the containers by default.
+	Autodiscovery AutodiscoveryConfig `json:"autodiscovery"`
+	// Env are injected in the containers, their values are templates rendered at admission time.
+	Env []EnvTemplateConfig `json:"env"`
+}
+
+// SidecarConfig identifies the sidecar containers.
+type SidecarConfig struct {
+	// Names are the names of the containers always considered as sidecars.
+	Names []string `json:"names"`
+	// Images are regular expressions matched against the image of the containers.
+	Images []string `json:"images"`
+}
+
+// AgentServiceConfig identifies the Service exposing the node-local Agents. It is expected to
+// select the Pods of the Agent DaemonSet and to have `internalTrafficPolicy: Local`, so that the
+// traffic never leaves the Node.
+type AgentServiceConfig struct {
+	// Name is the name of the Service, datadog-agent by default.
+	Name string `json:"name"`
+	// Namespace is the Namespace of the Service, datadog by default.
+	Namespace string `json:"namespace"`
+}
+
+const (
+	defaultAgentServiceName      = "datadog-agent"
+	defaultAgentServiceNamespace = "datadog"
+)
+
+// validate returns an error if the name or the namespace is not a valid DNS label.
+func (c *AgentServiceConfig) validate() error {
+	if errs := validation.IsDNS1123Label(c.name()); len(errs) > 0 {
+		return fmt.Errorf("invalid name %q: %s", c.name(), strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Label(c.namespace()); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", c.namespace(), strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (c *AgentServiceConfig) name() string {
+	if c.Name == "" {
+		return defaultAgentServiceName
+	}
+	return c.Name
+}
+
+func (c *AgentServiceConfig) namespace() string {
+	if c.Namespace == "" {
+		return defaultAgentServiceNamespace
+	}
+	return c.Namespace
+}
+
+// host returns the DNS name of the Service.
+func (c *AgentServiceConfig) host() string {
+	return c.name() + "." + c.namespace() + ".svc"
+}
+
+// NewBuiltinMutators returns the built-in Mutators, in the order they must run: the environment,
+// which connects the containers to the Agent, then the APM library and the autodiscovery annotations.
+// defaultMode and defaultProfiles are used when neither the Pod nor its Namespace select them.
+// It compiles the sidecar patterns and the templates of the configuration, and returns an error if
+// the configuration is invalid.
+func NewBuiltinMutators(c *Config, namespaceLister corelisters.NamespaceLister, defaultMode InjectionMode, defaultProfiles []string) ([]Mutator, error) {
+	sidecars, err := newSidecarDetector(c.Sidecars)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sidecars configuration: %w", err)
+	}
+	autodiscovery, err := newAutodiscovery(c.Autodiscovery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid autodiscovery configuration: %w", err)
+	}
+	envTemplates, err := newEnvTemplates(c.Env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid env configuration: %w", err)
+	}
+	if err := c.AgentSidecar.validate(); err != nil {
+		return nil, fmt.Errorf("invalid agentSidecar configuration: %w", err)
+	}
+	if err := c.AgentService.validate(); err != nil {
+		return nil, fmt.Errorf("invalid agentService configuration: %w", err)
+	}
+
+	return []Mutator{
+		&environmentMutator{
+			namespaceLister: namespaceLister,
+			sidecars:        sidecars,
+			envTemplates:    envTemplates,
+			agentSidecar:    &c.AgentSidecar,
+			agentService:    &c.AgentService,
+			defaultMode:     defaultMode,
+			defaultProfiles: defaultProfiles,
+		},
+		&apmLibraryMutator{
+			sidecars:     sidecars,
+			apmLibraries: &c.APMLibraries,
+		},
+		&autodiscoveryMutator{
+			sidecars:      sidecars,
+			autodiscovery: autodiscovery,
+		},
+	}, nil
+}
@@ -0,0 +1,122 @@
+package mutation
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// envVarReferences returns the names of the variables referenced by value using the `$(VAR)`
+// syntax expanded by Kubernetes. `$$` escapes a `$`, an unterminated reference is not one.
+func envVarReferences(value string) []string {
+	var references []string
+	for i := 0; i < len(value)-1; i++ {
+		if value[i] != '$' {
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			// Escaped `$`
+			i++
+		case '(':
+			end := strings.IndexByte(value[i+2:], ')')
+			if end < 0 {
+				return references
+			}
+			references = append(references, value[i+2:i+2+end])
+			i += 2 + end
+		}
+	}
+	return references
+}
+
+// sortByDependencies orders envVars such that every variable comes after the variables of the
+// list it references, since Kubernetes only expands references to variables defined earlier.
+// The original order is otherwise preserved.
+func sortByDependencies(envVars []corev1.EnvVar) []corev1.EnvVar {
+	index := make(map[string]int, len(envVars))
+	for i, envVar := range envVars {
+		index[envVar.Name] = i
+	}
+
+	visited := make([]bool, len(envVars))
+	sorted := make([]corev1.EnvVar, 0, len(envVars))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		// Marking before visiting the dependencies breaks the cycles
+		visited[i] = true
+		for _, reference := range envVarReferences(envVars[i].Value) {
+			if j, ok := index[reference]; ok {
+				visit(j)
+			}
+		}
+		sorted = append(sorted, envVars[i])
+	}
+	for i := range envVars {
+		visit(i)
+	}
+	return sorted
+}
+
+// envVarInsertion is an environment variable inserted at index of the resulting environment.
+type envVarInsertion struct {
+	index  int
+	envVar corev1.EnvVar
+}
+
+// insertEnvVars computes where the injected variables must be inserted in the existing environment
+// of a container: each of them is inserted before the first variable referencing it, existing or
+// injected, and appended otherwise. injected must be sorted by dependencies and its relative order
+// is preserved among the appended variables. The insertions are returned by increasing index, so
+// that inserting them in this order yields the resulting environment.
+func insertEnvVars(existing, injected []corev1.EnvVar) []envVarInsertion {
+	type entry struct {
+		envVar   corev1.EnvVar
+		injected bool
+	}
+	env := make([]entry, 0, len(existing)+len(injected))
+	for _, envVar := range existing {
+		env = append(env, entry{envVar: envVar})
+	}
+
+	// Processing the injected variables backward guarantees that their dependents, injected
+	// or not, are already in place when looking for the first of them.
+	// tail is the index of the first appended variable.
+	tail := len(existing)
+	for i := len(injected) - 1; i >= 0; i-- {
+		position := tail
+		for j := 0; j < position; j++ {
+			if referencesEnvVar(env[j].envVar.Value, injected[i].Name) {
+				position = j
+				break
+			}
+		}
+		if position < tail {
+			tail++
+		}
+		env = append(env, entry{})
+		copy(env[position+1:], env[position:])
+		env[position] = entry{envVar: injected[i], injected: true}
+	}
+
+	insertions := make([]envVarInsertion, 0, len(injected))
+	for i, entry := range env {
+		if entry.injected {
+			insertions = append(insertions, envVarInsertion{index: i, envVar: entry.envVar})
+		}
+	}
+	return insertions
+}
+
+// referencesEnvVar returns true if value references the variable named name.
+func referencesEnvVar(value, name string) bool {
+	for _, reference := range envVarReferences(value) {
+		if reference == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package mutation
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestEnvVarReferences(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{value: "", expected: nil},
+		{value: "plain", expected: nil},
+		{value: "$(FOO)", expected: []string{"FOO"}},
+		{value: "http://$(HOST_IP):$(PORT)/path", expected: []string{"HOST_IP", "PORT"}},
+		{value: "$$(ESCAPED) $(FOO)", expected: []string{"FOO"}},
+		{value: "$$$(FOO)", expected: []string{"FOO"}},
+		{value: "$(UNTERMINATED", expected: nil},
+		{value: "$FOO $", expected: nil},
+	}
+	for _, test := range tests {
+		if got := envVarReferences(test.value); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("envVarReferences(%q) = %v, want %v", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestSortByDependencies(t *testing.T) {
+	envVars := []corev1.EnvVar{
+		{Name: "ENDPOINT", Value: "http://$(HOST):$(PORT)"},
+		{Name: "UNRELATED", Value: "foo"},
+		{Name: "HOST", Value: "$(PREFIX).local"},
+		{Name: "PORT", Value: "4317"},
+		{Name: "PREFIX", Value: "node"},
+		{Name: "CYCLE_A", Value: "$(CYCLE_B)"},
+		{Name: "CYCLE_B", Value: "$(CYCLE_A)"},
+	}
+	var names []string
+	for _, envVar := range sortByDependencies(envVars) {
+		names = append(names, envVar.Name)
+	}
+	expected := []string{"PREFIX", "HOST", "PORT", "ENDPOINT", "UNRELATED", "CYCLE_B", "CYCLE_A"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Unexpected order: got %v, want %v", names, expected)
+	}
+}
+
+func TestInsertEnvVars(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []corev1.EnvVar
+		injected []corev1.EnvVar
+		expected []string
+	}{{
+		name:     "no dependent",
+		existing: []corev1.EnvVar{{Name: "FOO"}, {Name: "BAR"}},
+		injected: []corev1.EnvVar{{Name: "A"}, {Name: "B"}},
+		expected: []string{"FOO", "BAR", "A", "B"},
+	}, {
+		name:     "existing dependent",
+		existing: []corev1.EnvVar{{Name: "FOO"}, {Name: "URL", Value: "http://$(HOST):8126"}, {Name: "BAR"}},
+		injected: []corev1.EnvVar{{Name: "HOST"}, {Name: "OTHER"}},
+		expected: []string{"FOO", "HOST", "URL", "BAR", "OTHER"},
+	}, {
+		name:     "transitive dependent",
+		existing: []corev1.EnvVar{{Name: "FOO"}, {Name: "URL", Value: "$(ENDPOINT)/v1"}},
+		injected: []corev1.EnvVar{{Name: "HOST"}, {Name: "PORT"}, {Name: "ENDPOINT", Value: "http://$(HOST):$(PORT)"}},
+		expected: []string{"FOO", "PORT", "HOST", "ENDPOINT", "URL"},
+	}, {
+		name:     "injected dependent",
+		existing: []corev1.EnvVar{{Name: "FOO"}},
+		injected: []corev1.EnvVar{{Name: "HOST"}, {Name: "ENDPOINT", Value: "http://$(HOST)"}},
+		expected: []string{"FOO", "HOST", "ENDPOINT"},
+	}, {
+		name:     "escaped reference",
+		existing: []corev1.EnvVar{{Name: "FOO", Value: "$$(HOST)"}},
+		injected: []corev1.EnvVar{{Name: "HOST"}},
+		expected: []string{"FOO", "HOST"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Apply the insertions in order, as the JSON patch would
+			env := append([]corev1.EnvVar(nil), test.existing...)
+			for _, insertion := range insertEnvVars(test.existing, test.injected) {
+				env = append(env, corev1.EnvVar{})
+				copy(env[insertion.index+1:], env[insertion.index:])
+				env[insertion.index] = insertion.envVar
+			}
+			var names []string
+			for _, envVar := range env {
+				names = append(names, envVar.Name)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Fatalf("Unexpected env: got %v, want %v", names, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// injectedEnvAnnotation records, on the Pod template of a workload, the names of the variables
+// injected in each container, as a JSON object. They are reconciled when the workload is mutated
+// again, e.g. after a change of its injection mode, rather than kept as if set by the user.
+const injectedEnvAnnotation = "node-ip-webhook/injected-env"
+
+// environmentMutator injects the environment variables connecting the containers to the Agent,
+// along with the volumes and containers of the injection mode.
+type environmentMutator struct {
+	namespaceLister corelisters.NamespaceLister
+	sidecars        *sidecarDetector
+	envTemplates    []envTemplate
+	agentSidecar    *AgentSidecarConfig
+	agentService    *AgentServiceConfig
+
+	// defaultMode is used when neither the Pod nor its Namespace select an injection mode.
+	defaultMode InjectionMode
+	// defaultProfiles are used when neither the Pod nor its Namespace select profiles.
+	defaultProfiles []string
+}
+
+// Name implements Mutator.
+func (m *environmentMutator) Name() string {
+	return "environment"
+}
+
+// Mutate implements Mutator.
+func (m *environmentMutator) Mutate(req *Request) (*Result, error) {
+	template := req.Template
+	namespace := req.Admission.Namespace
+
+	mode, err := m.injectionMode(template.Annotations, namespace)
+	if err != nil {
+		return nil, err
+	}
+	// There is no node-local Agent to reach whatever the selected mode
+	if m.agentSidecar.targets(&template.Spec) {
+		mode = SidecarMode
+	}
+	if mode == SidecarMode && !m.agentSidecar.isConfigured() {
+		return nil, deny("the %q injection mode requires the agentSidecar configuration", SidecarMode)
+	}
+	profileNames, err := m.profiles(template.Annotations, namespace)
+	if err != nil {
+		return nil, err
+	}
+	previouslyInjected := make(map[string][]string)
+	if value, ok := template.Annotations[injectedEnvAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &previouslyInjected); err != nil {
+			return nil, deny("invalid annotation %q: %w", injectedEnvAnnotation, err)
+		}
+	}
+
+	envVars := mergeEnvVars(mode.envVars(m.agentService), unifiedServiceTagEnvVars(template.ExpectedPodLabels()))
+	for _, name := range profileNames {
+		envVars = mergeEnvVars(envVars, profiles[name])
+	}
+	// Injected variables can reference each other, e.g. a profile can reference a variable of the mode
+	envVars = sortByDependencies(envVars)
+
+	var patch patchBuilder
+	var warnings []string
+	var volumeName string
+	skipped := make(map[string]string)
+	injected := make(map[string][]string)
+	mutated := false
+	for i, container := range template.Spec.Containers {
+		if reason := m.sidecars.detect(template, container); reason != "" {
+			req.Log.Info("Skipping the sidecar container", "container", container.Name, "reason", reason)
+			skipped[container.Name] = reason
+			continue
+		}
+		mutated = true
+
+		containerEnvVars := envVars
+		if len(m.envTemplates) > 0 {
+			rendered, err := renderEnvTemplates(m.envTemplates, newTemplateData(template, namespace, container))
+			if err != nil {
+				return nil, err
+			}
+			containerEnvVars = sortByDependencies(mergeEnvVars(envVars, rendered))
+		}
+		if previous := previouslyInjected[container.Name]; len(previous) > 0 {
+			env, missing, containerWarnings := reconcileEnvVars(container, previous, containerEnvVars)
+			warnings = append(warnings, containerWarnings...)
+			if !reflect.DeepEqual(env, container.Env) {
+				patch.add(template.ContainerPath(i)+"/env", env)
+			}
+			containerEnvVars = missing
+		} else {
+			var containerWarnings []string
+			containerEnvVars, containerWarnings = missingEnvVars(container, containerEnvVars)
+			warnings = append(warnings, containerWarnings...)
+			patch.addEnvVars(template.ContainerPath(i), container.Env, containerEnvVars)
+		}
+		for _, envVar := range containerEnvVars {
+			injected[container.Name] = append(injected[container.Name], envVar.Name)
+		}
+
+		if mode == SocketMode {
+			if volumeName == "" {
+				var create bool
+				volumeName, create = socketVolume(&template.Spec)
+				if create {
+					patch.addVolume(template.SpecPath(), template.Spec.Volumes, corev1.Volume{
+						Name: volumeName,
+						VolumeSource: corev1.VolumeSource{
+							HostPath: &corev1.HostPathVolumeSource{Path: socketHostPath},
+						},
+					})
+				}
+			}
+			if !hasVolumeMount(container.VolumeMounts, socketHostPath) {
+				patch.addVolumeMount(template.ContainerPath(i), container.VolumeMounts, corev1.VolumeMount{
+					Name:      volumeName,
+					MountPath: socketHostPath,
+					ReadOnly:  true,
+				})
+			}
+		}
+	}
+
+	if mode == SidecarMode && mutated && !hasContainer(template.Spec.Containers, agentSidecarContainerName) {
+		patch.add(template.ContainerPath(len(template.Spec.Containers)), m.agentSidecar.container())
+	}
+
+	// The Pods can't be mutated again, only the workloads need to remember what was injected
+	if !template.IsPod() && (len(injected) > 0 || len(previouslyInjected) > 0) {
+		value, err := json.Marshal(injected)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the annotation %q: %w", injectedEnvAnnotation, err)
+		}
+		if string(value) != template.Annotations[injectedEnvAnnotation] {
+			patch.addAnnotations(template.MetadataPath(), template.HasMetadata, template.Annotations, map[string]string{injectedEnvAnnotation: string(value)})
+		}
+	}
+
+	// A workload injected before injectedEnvAnnotation existed contains its own variables, which
+	// can't be told apart from the ones of the user
+	if template.Annotations[injectedAnnotation] == "true" && len(previouslyInjected) == 0 {
+		warnings = nil
+	}
+
+	result := &Result{Patch: patch.operations, Warnings: warnings}
+	if len(skipped) > 0 {
+		result.AuditAnnotations = map[string]string{
+			skippedContainersAuditAnnotation: formatSkippedContainers(skipped),
+		}
+	}
+	return result, nil
+}
+
+// injectionMode returns the injection mode of the Pod: its annotation takes precedence over
+// the annotation of its Namespace, which takes precedence over the default mode.
+func (m *environmentMutator) injectionMode(annotations map[string]string, namespace string) (InjectionMode, error) {
+	value, ok, err := m.annotation(annotations, namespace, ModeAnnotation)
+	if err != nil || !ok {
+		return m.defaultMode, err
+	}
+	mode, err := ParseInjectionMode(value)
+	if err != nil {
+		return "", deny("invalid annotation %q: %w", ModeAnnotation, err)
+	}
+	return mode, nil
+}
+
+// profiles returns the names of the profiles injected in the Pod, resolved like the injection mode.
+func (m *environmentMutator) profiles(annotations map[string]string, namespace string) ([]string, error) {
+	value, ok, err := m.annotation(annotations, namespace, ProfilesAnnotation)
+	if err != nil || !ok {
+		return m.defaultProfiles, err
+	}
+	names, err := ParseProfiles(value)
+	if err != nil {
+		return nil, deny("invalid annotation %q: %w", ProfilesAnnotation, err)
+	}
+	return names, nil
+}
+
+// annotation returns the value of the annotation key among the annotations of the Pod, or of its
+// Namespace if the Pod isn't annotated. ok is false if neither of them is annotated.
+func (m *environmentMutator) annotation(annotations map[string]string, namespace, key string) (value string, ok bool, err error) {
+	if value, ok := annotations[key]; ok {
+		return value, true, nil
+	}
+
+	ns, err := m.namespaceLister.Get(namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to get the Namespace %q: %w", namespace, err)
+	}
+	value, ok = ns.Annotations[key]
+	return value, ok, nil
+}
+
+// missingEnvVars returns the entries of envVars not already defined by the container, along with
+// a warning for each of the others.
+func missingEnvVars(container corev1.Container, envVars []corev1.EnvVar) ([]corev1.EnvVar, []string) {
+	var missing []corev1.EnvVar
+	var warnings []string
+	for _, envVar := range envVars {
+		if hasEnvVar(container.Env, envVar.Name) {
+			warnings = append(warnings, fmt.Sprintf("container %q already contains an environment variable entry for %q, keeping the original value", container.Name, envVar.Name))
+			continue
+		}
+		missing = append(missing, envVar)
+	}
+	return missing, warnings
+}
+
+// reconcileEnvVars returns the environment of the container once the variables named previous,
+// injected by an earlier mutation, are replaced by envVars: the ones no longer injected are removed
+// and the others updated. It also returns the entries of envVars injected, as missingEnvVars, and
+// a warning for each of the others, defined by the user.
+func reconcileEnvVars(container corev1.Container, previous []string, envVars []corev1.EnvVar) ([]corev1.EnvVar, []corev1.EnvVar, []string) {
+	injected := make(map[string]bool, len(previous))
+	for _, name := range previous {
+		injected[name] = true
+	}
+	var userEnvVars []corev1.EnvVar
+	for _, envVar := range container.Env {
+		if !injected[envVar.Name] {
+			userEnvVars = append(userEnvVars, envVar)
+		}
+	}
+	container.Env = userEnvVars
+	missing, warnings := missingEnvVars(container, envVars)
+
+	env := append([]corev1.EnvVar(nil), userEnvVars...)
+	for _, insertion := range insertEnvVars(userEnvVars, missing) {
+		env = append(env, corev1.EnvVar{})
+		copy(env[insertion.index+1:], env[insertion.index:])
+		env[insertion.index] = insertion.envVar
+	}
+	return env, missing, warnings
+}
+
+// hasEnvVar returns true if envVars contains an entry named name.
+func hasEnvVar(envVars []corev1.EnvVar, name string) bool {
+	for _, env := range envVars {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasVolumeMount returns true if volumeMounts contains an entry mounted at mountPath.
+func hasVolumeMount(volumeMounts []corev1.VolumeMount, mountPath string) bool {
+	for _, volumeMount := range volumeMounts {
+		if volumeMount.MountPath == mountPath {
+			return true
+		}
+	}
+	return false
+}
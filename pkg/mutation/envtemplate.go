@@ -0,0 +1,51 @@
+package mutation
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// EnvTemplateConfig is an environment variable whose value is computed at admission time.
+type EnvTemplateConfig struct {
+	Name string `json:"name"`
+	// Value is a template executed against templateData.
+	Value string `json:"value"`
+}
+
+// envTemplate is a parsed EnvTemplateConfig.
+type envTemplate struct {
+	name  string
+	value *valueTemplate
+}
+
+// newEnvTemplates parses the configured environment variables.
+func newEnvTemplates(configs []EnvTemplateConfig) ([]envTemplate, error) {
+	templates := make([]envTemplate, 0, len(configs))
+	for _, c := range configs {
+		if errs := validation.IsEnvVarName(c.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid name %q: %s", c.Name, strings.Join(errs, ", "))
+		}
+		value, err := parseValueTemplate(c.Name, c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %q: %w", c.Name, err)
+		}
+		templates = append(templates, envTemplate{name: c.Name, value: value})
+	}
+	return templates, nil
+}
+
+// renderEnvTemplates returns the environment variables rendered against data.
+func renderEnvTemplates(templates []envTemplate, data templateData) ([]corev1.EnvVar, error) {
+	envVars := make([]corev1.EnvVar, 0, len(templates))
+	for _, t := range templates {
+		value, err := t.value.execute(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render the environment variable %q: %w", t.name, err)
+		}
+		envVars = append(envVars, corev1.EnvVar{Name: t.name, Value: value})
+	}
+	return envVars, nil
+}
@@ -0,0 +1,80 @@
+package mutation
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// InjectionMode defines how the containers reach the Datadog Agent running on their Node.
+type InjectionMode string
+
+const (
+	// HostIPMode injects the IP of the Node via the Downward API.
+	HostIPMode InjectionMode = "hostip"
+
+	// SocketMode mounts the directory containing the Agent Unix Domain Sockets
+	// and points the DogStatsD and trace clients at them.
+	SocketMode InjectionMode = "socket"
+
+	// SidecarMode injects an Agent container in the Pod, for the Nodes without a node-local Agent.
+	SidecarMode InjectionMode = "sidecar"
+
+	// ServiceMode points at the Service exposing the node-local Agents, which works when the
+	// network policies block the traffic to the IP of the Node.
+	ServiceMode InjectionMode = "service"
+)
+
+const (
+	// ModeAnnotation selects the injection mode of a Pod. It can be set on the Pod or on its Namespace.
+	ModeAnnotation = "node-ip-webhook/mode"
+
+	// AgentHostEnvVarName is the environment variable containing the address of the Agent.
+	AgentHostEnvVarName = "DD_AGENT_HOST"
+
+	// socketHostPath is the directory of the Node where the Agent creates its sockets.
+	socketHostPath = "/var/run/datadog"
+	// socketVolumeName is the name of the volume mounting socketHostPath, suffixed if already taken.
+	socketVolumeName = "datadog-agent-sockets"
+)
+
+// ParseInjectionMode returns the InjectionMode named s.
+func ParseInjectionMode(s string) (InjectionMode, error) {
+	switch mode := InjectionMode(s); mode {
+	case HostIPMode, SocketMode, SidecarMode, ServiceMode:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown injection mode %q, must be one of %q, %q, %q, %q", s, HostIPMode, SocketMode, SidecarMode, ServiceMode)
+	}
+}
+
+// envVars returns the environment variables injected in each container for this mode.
+// agentService is the Service targeted by ServiceMode.
+func (mode InjectionMode) envVars(agentService *AgentServiceConfig) []corev1.EnvVar {
+	switch mode {
+	case SocketMode:
+		return []corev1.EnvVar{
+			{Name: "DD_DOGSTATSD_URL", Value: "unix://" + socketHostPath + "/dsd.socket"},
+			{Name: "DD_TRACE_AGENT_URL", Value: "unix://" + socketHostPath + "/apm.socket"},
+		}
+	case SidecarMode:
+		return []corev1.EnvVar{{Name: AgentHostEnvVarName, Value: "localhost"}}
+	case ServiceMode:
+		return []corev1.EnvVar{{Name: AgentHostEnvVarName, Value: agentService.host()}}
+	default:
+		return []corev1.EnvVar{fieldRefEnvVar(AgentHostEnvVarName, "status.hostIP")}
+	}
+}
+
+// socketVolume returns the name of the volume mounting socketHostPath in the Pod spec and
+// whether it must be added. A volume of the Pod already mounting that directory is reused.
+func socketVolume(spec *corev1.PodSpec) (string, bool) {
+	names := make(map[string]bool, len(spec.Volumes))
+	for _, volume := range spec.Volumes {
+		if volume.HostPath != nil && volume.HostPath.Path == socketHostPath {
+			return volume.Name, false
+		}
+		names[volume.Name] = true
+	}
+	return uniqueName(socketVolumeName, names), true
+}
@@ -0,0 +1,1141 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	gomodulesjsonpatch "gomodules.xyz/jsonpatch/v3"
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var hostIPEnvVar = corev1.EnvVar{
+	Name: AgentHostEnvVarName,
+	ValueFrom: &corev1.EnvVarSource{
+		FieldRef: &corev1.ObjectFieldSelector{
+			FieldPath: "status.hostIP",
+		},
+	},
+}
+
+var queueProxyContainer = corev1.Container{
+	Name:  "queue-proxy",
+	Image: "gcr.io/knative-releases/knative.dev/serving/cmd/queue@sha256:0123456789abcdef",
+}
+
+func TestMutate(t *testing.T) {
+	userEnvVar := corev1.EnvVar{Name: "FOO", Value: "bar"}
+	userAgentHost := corev1.EnvVar{Name: AgentHostEnvVarName, Value: "1.2.3.4"}
+
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		expected   [][]corev1.EnvVar
+	}{{
+		name:       "no env",
+		containers: []corev1.Container{{Name: "user-container"}},
+		expected:   [][]corev1.EnvVar{{hostIPEnvVar}},
+	}, {
+		name:       "empty env",
+		containers: []corev1.Container{{Name: "user-container", Env: []corev1.EnvVar{}}},
+		expected:   [][]corev1.EnvVar{{hostIPEnvVar}},
+	}, {
+		name:       "existing env",
+		containers: []corev1.Container{{Name: "user-container", Env: []corev1.EnvVar{userEnvVar}}},
+		expected:   [][]corev1.EnvVar{{userEnvVar, hostIPEnvVar}},
+	}, {
+		name:       "already defined",
+		containers: []corev1.Container{{Name: "user-container", Env: []corev1.EnvVar{userAgentHost}}},
+		expected:   [][]corev1.EnvVar{{userAgentHost}},
+	}, {
+		name: "queue-proxy is skipped",
+		containers: []corev1.Container{
+			{Name: "user-container", Env: []corev1.EnvVar{userEnvVar}},
+			queueProxyContainer,
+		},
+		expected: [][]corev1.EnvVar{{userEnvVar, hostIPEnvVar}, nil},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: test.containers}}
+			mutated := mutateAndApply(t, newTestPipeline(t), pod)
+			for i, container := range mutated.Spec.Containers {
+				if len(container.Env) == 0 && len(test.expected[i]) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(container.Env, test.expected[i]) {
+					t.Errorf("Unexpected env for container %q: got %v, want %v", container.Name, container.Env, test.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMutateInsertsBeforeDependents(t *testing.T) {
+	traceAgentURL := corev1.EnvVar{Name: "DD_TRACE_AGENT_URL", Value: "http://$(DD_AGENT_HOST):8126"}
+	pod := newAnnotatedPod(nil)
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "FOO", Value: "bar"}, traceAgentURL}
+	req := newAdmissionRequest(t, pod)
+	resp, err := newTestPipeline(t).Mutate(req)
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(resp.Patch, &operations); err != nil {
+		t.Fatalf("Failed to decode the patch: %v", err)
+	}
+	if len(operations) != 1 || operations[0]["path"] != "/spec/containers/0/env/1" {
+		t.Fatalf("A single positional insert is expected: %s", resp.Patch)
+	}
+
+	var mutated corev1.Pod
+	if err := json.Unmarshal(applyJSONPatch(t, req.Object.Raw, resp.Patch), &mutated); err != nil {
+		t.Fatalf("Failed to decode the mutated Pod: %v", err)
+	}
+	expected := []corev1.EnvVar{{Name: "FOO", Value: "bar"}, hostIPEnvVar, traceAgentURL}
+	if !reflect.DeepEqual(mutated.Spec.Containers[0].Env, expected) {
+		t.Fatalf("Unexpected env: got %v, want %v", mutated.Spec.Containers[0].Env, expected)
+	}
+}
+
+func TestMutateRecordsSkippedContainers(t *testing.T) {
+	resp, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, newAnnotatedPod(nil)))
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+	expected := map[string]string{skippedContainersAuditAnnotation: "queue-proxy: Knative queue-proxy image"}
+	if !reflect.DeepEqual(resp.AuditAnnotations, expected) {
+		t.Fatalf("Unexpected audit annotations: got %v, want %v", resp.AuditAnnotations, expected)
+	}
+}
+
+func TestMutateWithoutChangeReturnsNoPatch(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{queueProxyContainer}}}
+	resp, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, pod))
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+	if !resp.Allowed {
+		t.Fatalf("The Pod should be allowed")
+	}
+	if resp.Patch != nil || resp.PatchType != nil {
+		t.Fatalf("No patch should be returned: %s", resp.Patch)
+	}
+}
+
+func TestMutatePreservesUnknownFields(t *testing.T) {
+	// Fields that don't exist in the vendored k8s.io/api types, at every level touched by the mutation.
+	raw := []byte(`{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {"name": "future", "namespace": "default"},
+  "spec": {
+    "hostUsers": false,
+    "schedulingGates": [{"name": "example.com/gate"}],
+    "containers": [{
+      "name": "user-container",
+      "image": "image",
+      "resizePolicy": [{"resourceName": "cpu", "restartPolicy": "NotRequired"}],
+      "env": [{"name": "FOO", "value": "bar", "futureField": {"a": 1}}]
+    }, {
+      "name": "sidecar",
+      "image": "image",
+      "restartPolicy": "Always"
+    }]
+  }
+}`)
+	req := &admiv1beta1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: admiv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	resp, err := newTestPipeline(t).Mutate(req)
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(resp.Patch, &operations); err != nil {
+		t.Fatalf("Failed to decode the patch: %v", err)
+	}
+	for _, operation := range operations {
+		if operation["op"] != "add" {
+			t.Errorf("Only add operations are expected, got: %v", operation)
+		}
+	}
+
+	var original, mutated map[string]interface{}
+	if err := json.Unmarshal(raw, &original); err != nil {
+		t.Fatalf("Failed to decode the original Pod: %v", err)
+	}
+	if err := json.Unmarshal(applyJSONPatch(t, raw, resp.Patch), &mutated); err != nil {
+		t.Fatalf("Failed to decode the mutated Pod: %v", err)
+	}
+
+	// Removing the injected entries must yield the original object
+	containers := mutated["spec"].(map[string]interface{})["containers"].([]interface{})
+	first := containers[0].(map[string]interface{})
+	env := first["env"].([]interface{})
+	first["env"] = env[:len(env)-1]
+	delete(containers[1].(map[string]interface{}), "env")
+	if !reflect.DeepEqual(original, mutated) {
+		t.Fatalf("Fields unknown to the vendored types were modified:\noriginal: %v\nmutated:  %v", original, mutated)
+	}
+}
+
+func TestMutateSocketMode(t *testing.T) {
+	socketEnvVars := SocketMode.envVars(nil)
+	socketVolumeMount := corev1.VolumeMount{Name: socketVolumeName, MountPath: socketHostPath, ReadOnly: true}
+
+	tests := []struct {
+		name           string
+		namespace      *corev1.Namespace
+		pod            *corev1.Pod
+		expectedVolume string
+	}{{
+		name:           "pod annotation",
+		pod:            newAnnotatedPod(map[string]string{ModeAnnotation: "socket"}),
+		expectedVolume: socketVolumeName,
+	}, {
+		name:           "namespace annotation",
+		namespace:      newAnnotatedNamespace(map[string]string{ModeAnnotation: "socket"}),
+		pod:            newAnnotatedPod(nil),
+		expectedVolume: socketVolumeName,
+	}, {
+		name: "volume name collision",
+		pod: func() *corev1.Pod {
+			pod := newAnnotatedPod(map[string]string{ModeAnnotation: "socket"})
+			pod.Spec.Volumes = []corev1.Volume{{Name: socketVolumeName}, {Name: socketVolumeName + "-1"}}
+			return pod
+		}(),
+		expectedVolume: socketVolumeName + "-2",
+	}, {
+		name: "existing hostPath volume is reused",
+		pod: func() *corev1.Pod {
+			pod := newAnnotatedPod(map[string]string{ModeAnnotation: "socket"})
+			pod.Spec.Volumes = []corev1.Volume{{
+				Name:         "dd",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: socketHostPath}},
+			}}
+			return pod
+		}(),
+		expectedVolume: "dd",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var namespaces []*corev1.Namespace
+			if test.namespace != nil {
+				namespaces = append(namespaces, test.namespace)
+			}
+			mutated := mutateAndApply(t, newTestPipeline(t, namespaces...), test.pod)
+
+			volume := mutated.Spec.Volumes[len(mutated.Spec.Volumes)-1]
+			if volume.Name != test.expectedVolume || volume.HostPath == nil || volume.HostPath.Path != socketHostPath {
+				t.Errorf("Unexpected socket volume: %v", volume)
+			}
+			for _, container := range mutated.Spec.Containers {
+				if container.Name == "queue-proxy" {
+					if len(container.Env) != 0 || len(container.VolumeMounts) != 0 {
+						t.Errorf("The queue-proxy container should not be mutated: %v", container)
+					}
+					continue
+				}
+				if !reflect.DeepEqual(container.Env, socketEnvVars) {
+					t.Errorf("Unexpected env for container %q: got %v, want %v", container.Name, container.Env, socketEnvVars)
+				}
+				expectedVolumeMount := socketVolumeMount
+				expectedVolumeMount.Name = test.expectedVolume
+				if !reflect.DeepEqual(container.VolumeMounts, []corev1.VolumeMount{expectedVolumeMount}) {
+					t.Errorf("Unexpected volume mounts for container %q: %v", container.Name, container.VolumeMounts)
+				}
+			}
+		})
+	}
+}
+
+func TestMutatePodAnnotationOverridesNamespace(t *testing.T) {
+	ns := newAnnotatedNamespace(map[string]string{ModeAnnotation: "socket"})
+	pod := newAnnotatedPod(map[string]string{ModeAnnotation: "hostip"})
+	mutated := mutateAndApply(t, newTestPipeline(t, ns), pod)
+	if !reflect.DeepEqual(mutated.Spec.Containers[0].Env, []corev1.EnvVar{hostIPEnvVar}) {
+		t.Fatalf("Unexpected env: %v", mutated.Spec.Containers[0].Env)
+	}
+	if len(mutated.Spec.Volumes) != 0 {
+		t.Fatalf("No volume should be added: %v", mutated.Spec.Volumes)
+	}
+}
+
+func TestMutateInvalidMode(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{ModeAnnotation: "carrier-pigeon"})
+	if _, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, pod)); !IsDenied(err) {
+		t.Fatalf("An invalid injection mode should be rejected, got: %v", err)
+	}
+}
+
+func TestMutateServiceMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		agentService AgentServiceConfig
+		expected     string
+	}{{
+		name:         "default service",
+		agentService: AgentServiceConfig{},
+		expected:     "datadog-agent.datadog.svc",
+	}, {
+		name:         "configured service",
+		agentService: AgentServiceConfig{Name: "agent", Namespace: "monitoring"},
+		expected:     "agent.monitoring.svc",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Config{AgentService: test.agentService}
+			p := newConfiguredPipeline(t, c, nil, newAnnotatedNamespace(map[string]string{ModeAnnotation: "service"}))
+			mutated := mutateAndApply(t, p, newAnnotatedPod(nil))
+
+			expected := []corev1.EnvVar{{Name: AgentHostEnvVarName, Value: test.expected}}
+			if env := mutated.Spec.Containers[0].Env; !reflect.DeepEqual(env, expected) {
+				t.Fatalf("Unexpected env: got %v, want %v", env, expected)
+			}
+			if len(mutated.Spec.Volumes) != 0 || len(mutated.Spec.Containers) != 2 {
+				t.Fatalf("Only the environment should be mutated: %v", mutated.Spec)
+			}
+		})
+	}
+}
+
+func TestMutateAPMLibrary(t *testing.T) {
+	javaAgent := "-javaagent:" + apmLibraryMountPath + "/dd-java-agent.jar"
+	libraryVolumeMount := corev1.VolumeMount{Name: apmLibraryVolumeName, MountPath: apmLibraryMountPath}
+	initContainer := corev1.Container{
+		Name:         apmLibraryInitContainerName,
+		Image:        defaultAPMLibraryRegistry + "/dd-lib-java-init:v1.20.0",
+		Command:      []string{"sh", "copy-lib.sh", apmLibraryMountPath},
+		VolumeMounts: []corev1.VolumeMount{libraryVolumeMount},
+	}
+
+	tests := []struct {
+		name                 string
+		annotations          map[string]string
+		env                  []corev1.EnvVar
+		initContainers       []corev1.Container
+		expectedEnv          []corev1.EnvVar
+		expectedVolumes      []string
+		expectedVolumeMounts []corev1.VolumeMount
+		expectedInit         []corev1.Container
+	}{{
+		name:                 "java",
+		annotations:          map[string]string{apmLibraryAnnotation: "java:v1.20.0"},
+		expectedEnv:          []corev1.EnvVar{hostIPEnvVar, {Name: "JAVA_TOOL_OPTIONS", Value: javaAgent}},
+		expectedVolumes:      []string{apmLibraryVolumeName},
+		expectedVolumeMounts: []corev1.VolumeMount{libraryVolumeMount},
+		expectedInit:         []corev1.Container{initContainer},
+	}, {
+		name:                 "existing value is appended to",
+		annotations:          map[string]string{apmLibraryAnnotation: "java:v1.20.0"},
+		env:                  []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g"}},
+		expectedEnv:          []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx1g " + javaAgent}, hostIPEnvVar},
+		expectedVolumes:      []string{apmLibraryVolumeName},
+		expectedVolumeMounts: []corev1.VolumeMount{libraryVolumeMount},
+		expectedInit:         []corev1.Container{initContainer},
+	}, {
+		name:            "with the socket mode",
+		annotations:     map[string]string{apmLibraryAnnotation: "java:v1.20.0", ModeAnnotation: "socket"},
+		expectedEnv:     append(SocketMode.envVars(nil), corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: javaAgent}),
+		expectedVolumes: []string{socketVolumeName, apmLibraryVolumeName},
+		expectedVolumeMounts: []corev1.VolumeMount{
+			{Name: socketVolumeName, MountPath: socketHostPath, ReadOnly: true},
+			libraryVolumeMount,
+		},
+		expectedInit: []corev1.Container{initContainer},
+	}, {
+		name:                 "already injected",
+		annotations:          map[string]string{apmLibraryAnnotation: "java:v1.20.0"},
+		env:                  []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: javaAgent}},
+		initContainers:       []corev1.Container{initContainer},
+		expectedEnv:          []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: javaAgent}, hostIPEnvVar},
+		expectedVolumeMounts: []corev1.VolumeMount{libraryVolumeMount},
+		expectedInit:         []corev1.Container{initContainer},
+	}, {
+		name:                 "new version",
+		annotations:          map[string]string{apmLibraryAnnotation: "java:v1.21.0"},
+		env:                  []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: javaAgent}},
+		initContainers:       []corev1.Container{initContainer},
+		expectedEnv:          []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS", Value: javaAgent}, hostIPEnvVar},
+		expectedVolumeMounts: []corev1.VolumeMount{libraryVolumeMount},
+		expectedInit: func() []corev1.Container {
+			upgraded := initContainer
+			upgraded.Image = defaultAPMLibraryRegistry + "/dd-lib-java-init:v1.21.0"
+			return []corev1.Container{upgraded}
+		}(),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := newAnnotatedPod(test.annotations)
+			pod.Spec.Containers[0].Env = test.env
+			pod.Spec.InitContainers = test.initContainers
+			mutated := mutateAndApply(t, newTestPipeline(t), pod)
+
+			container := mutated.Spec.Containers[0]
+			if !reflect.DeepEqual(container.Env, test.expectedEnv) {
+				t.Errorf("Unexpected env: got %v, want %v", container.Env, test.expectedEnv)
+			}
+			if !reflect.DeepEqual(container.VolumeMounts, test.expectedVolumeMounts) {
+				t.Errorf("Unexpected volume mounts: got %v, want %v", container.VolumeMounts, test.expectedVolumeMounts)
+			}
+			var volumes []string
+			for _, volume := range mutated.Spec.Volumes {
+				volumes = append(volumes, volume.Name)
+			}
+			if !reflect.DeepEqual(volumes, test.expectedVolumes) {
+				t.Errorf("Unexpected volumes: got %v, want %v", volumes, test.expectedVolumes)
+			}
+			if !reflect.DeepEqual(mutated.Spec.InitContainers, test.expectedInit) {
+				t.Errorf("Unexpected init containers: got %v, want %v", mutated.Spec.InitContainers, test.expectedInit)
+			}
+			if len(mutated.Spec.Containers[1].VolumeMounts) != 0 {
+				t.Errorf("The sidecar should not be mutated: %v", mutated.Spec.Containers[1])
+			}
+		})
+	}
+}
+
+func TestMutateAPMLibraryEmptyPreloadValue(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{apmLibraryAnnotation: "java:v1.20.0"})
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "JAVA_TOOL_OPTIONS"}}
+	req := newAdmissionRequest(t, pod)
+	resp, err := newTestPipeline(t).Mutate(req)
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+
+	// The empty value is omitted, the patch must not expect it to exist
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(resp.Patch, &operations); err != nil {
+		t.Fatalf("Failed to decode the patch: %v", err)
+	}
+	for _, operation := range operations {
+		if operation["path"] == "/spec/containers/0/env/0/value" && operation["op"] != "add" {
+			t.Fatalf("The missing value should be added: %v", operation)
+		}
+	}
+
+	var mutated corev1.Pod
+	if err := json.Unmarshal(applyJSONPatch(t, req.Object.Raw, resp.Patch), &mutated); err != nil {
+		t.Fatalf("Failed to decode the mutated Pod: %v", err)
+	}
+	expected := "-javaagent:" + apmLibraryMountPath + "/dd-java-agent.jar"
+	if env := mutated.Spec.Containers[0].Env[0]; env.Name != "JAVA_TOOL_OPTIONS" || env.Value != expected {
+		t.Fatalf("Unexpected env var: got %v, want %q", env, expected)
+	}
+}
+
+func TestMutateInvalidAPMLibrary(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{apmLibraryAnnotation: "cobol:v1"})
+	if _, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, pod)); !IsDenied(err) {
+		t.Fatalf("An unknown language should be rejected, got: %v", err)
+	}
+}
+
+func TestMutateAutodiscovery(t *testing.T) {
+	c := &Config{Autodiscovery: AutodiscoveryConfig{Annotations: map[string]string{
+		"logs": `[{"source":"{{.Labels.app}}","service":"{{index .Labels "tags.datadoghq.com/service"}}"}]`,
+		"tags": `{{with .Labels.team}}{"team":"{{.}}"}{{end}}`,
+	}}}
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		expected    map[string]string
+	}{{
+		name:   "no annotations",
+		labels: map[string]string{"app": "nginx", serviceLabel: "web"},
+		expected: map[string]string{
+			"ad.datadoghq.com/user-container.logs": `[{"source":"nginx","service":"web"}]`,
+		},
+	}, {
+		name:        "existing annotations",
+		labels:      map[string]string{"app": "nginx", "team": "edge"},
+		annotations: map[string]string{"ad.datadoghq.com/user-container.logs": `[{"source":"custom"}]`, "a/b~c": "d"},
+		expected: map[string]string{
+			"ad.datadoghq.com/user-container.logs": `[{"source":"custom"}]`,
+			"ad.datadoghq.com/user-container.tags": `{"team":"edge"}`,
+			"a/b~c":                                "d",
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := newAnnotatedPod(test.annotations)
+			pod.Labels = test.labels
+			mutated := mutateAndApply(t, newConfiguredPipeline(t, c, nil), pod)
+			if !reflect.DeepEqual(mutated.Annotations, test.expected) {
+				t.Fatalf("Unexpected annotations: got %v, want %v", mutated.Annotations, test.expected)
+			}
+		})
+	}
+}
+
+func TestMutateAutodiscoveryInvalidKeys(t *testing.T) {
+	c := &Config{Autodiscovery: AutodiscoveryConfig{Annotations: map[string]string{"logs": `[{"source":"{{.Container.Name}}"}]`}}}
+
+	for _, name := range []string{"", strings.Repeat("a", 60)} {
+		pod := newAnnotatedPod(nil)
+		pod.Spec.Containers[0].Name = name
+		resp, err := newConfiguredPipeline(t, c, nil).Mutate(newAdmissionRequest(t, pod))
+		if err != nil {
+			t.Fatalf("Failed to mutate the container %q: %v", name, err)
+		}
+		warnings := resp.AuditAnnotations[warningsAuditAnnotation]
+		if !strings.Contains(warnings, fmt.Sprintf("autodiscovery: container %q skipped", name)) {
+			t.Errorf("The container %q should be skipped with a warning: %q", name, warnings)
+		}
+		if strings.Contains(string(resp.Patch), autodiscoveryAnnotationPrefix) {
+			t.Errorf("No annotation should be added for the container %q: %s", name, resp.Patch)
+		}
+	}
+}
+
+func TestMutateEnvTemplates(t *testing.T) {
+	p := newConfiguredPipeline(t, &Config{Env: []EnvTemplateConfig{
+		{Name: "DD_TAGS", Value: "team:{{.Labels.team}} ns:{{.Namespace}}"},
+		{Name: "DD_SERVICE_NAME", Value: "{{.Container.Name}}"},
+	}}, nil)
+
+	pod := newAnnotatedPod(nil)
+	pod.Labels = map[string]string{"team": "edge"}
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "DD_SERVICE_NAME", Value: "custom"}}
+	mutated := mutateAndApply(t, p, pod)
+
+	expected := []corev1.EnvVar{
+		{Name: "DD_SERVICE_NAME", Value: "custom"},
+		hostIPEnvVar,
+		{Name: "DD_TAGS", Value: "team:edge ns:default"},
+	}
+	if env := mutated.Spec.Containers[0].Env; !reflect.DeepEqual(env, expected) {
+		t.Fatalf("Unexpected env: got %v, want %v", env, expected)
+	}
+}
+
+func TestMutateAgentSidecar(t *testing.T) {
+	agentSidecar := &AgentSidecarConfig{
+		Selectors:    []NodePoolSelector{{NodeLabels: map[string]string{"type": "virtual-kubelet"}}},
+		Image:        "datadog/agent:7",
+		APIKeySecret: corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "datadog"}, Key: "api-key"},
+	}
+	localhostEnvVar := corev1.EnvVar{Name: AgentHostEnvVarName, Value: "localhost"}
+
+	tests := []struct {
+		name       string
+		pod        *corev1.Pod
+		containers []string
+	}{{
+		name: "node selector",
+		pod: func() *corev1.Pod {
+			pod := newAnnotatedPod(nil)
+			pod.Spec.NodeSelector = map[string]string{"type": "virtual-kubelet"}
+			return pod
+		}(),
+		containers: []string{"user-container", "queue-proxy", agentSidecarContainerName},
+	}, {
+		name: "overrides the mode annotation",
+		pod: func() *corev1.Pod {
+			pod := newAnnotatedPod(map[string]string{ModeAnnotation: "socket"})
+			pod.Spec.NodeSelector = map[string]string{"type": "virtual-kubelet"}
+			return pod
+		}(),
+		containers: []string{"user-container", "queue-proxy", agentSidecarContainerName},
+	}, {
+		name:       "mode annotation",
+		pod:        newAnnotatedPod(map[string]string{ModeAnnotation: "sidecar"}),
+		containers: []string{"user-container", "queue-proxy", agentSidecarContainerName},
+	}, {
+		name: "existing agent container",
+		pod: func() *corev1.Pod {
+			pod := newAnnotatedPod(map[string]string{ModeAnnotation: "sidecar"})
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: agentSidecarContainerName})
+			return pod
+		}(),
+		containers: []string{"user-container", "queue-proxy", agentSidecarContainerName},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mutated := mutateAndApply(t, newConfiguredPipeline(t, &Config{AgentSidecar: *agentSidecar}, nil), test.pod)
+
+			var names []string
+			for _, container := range mutated.Spec.Containers {
+				names = append(names, container.Name)
+			}
+			if !reflect.DeepEqual(names, test.containers) {
+				t.Fatalf("Unexpected containers: got %v, want %v", names, test.containers)
+			}
+			if env := mutated.Spec.Containers[0].Env; !reflect.DeepEqual(env, []corev1.EnvVar{localhostEnvVar}) {
+				t.Errorf("Unexpected env: %v", env)
+			}
+			if len(mutated.Spec.Volumes) != 0 {
+				t.Errorf("No volume should be added: %v", mutated.Spec.Volumes)
+			}
+			if len(test.pod.Spec.Containers) < len(mutated.Spec.Containers) {
+				agent := mutated.Spec.Containers[len(mutated.Spec.Containers)-1]
+				if !reflect.DeepEqual(agent, agentSidecar.container()) {
+					t.Errorf("Unexpected agent container: got %v, want %v", agent, agentSidecar.container())
+				}
+			}
+		})
+	}
+}
+
+func TestMutateAgentSidecarNotConfigured(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{ModeAnnotation: "sidecar"})
+	if _, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, pod)); !IsDenied(err) {
+		t.Fatalf("The sidecar mode should be rejected without the agentSidecar configuration, got: %v", err)
+	}
+}
+
+func TestMutateUnifiedServiceTagging(t *testing.T) {
+	labelEnvVar := func(name, label string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['" + label + "']"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		env      []corev1.EnvVar
+		expected []corev1.EnvVar
+	}{{
+		name:     "no labels",
+		expected: []corev1.EnvVar{hostIPEnvVar},
+	}, {
+		name: "datadog labels",
+		labels: map[string]string{
+			envLabel:     "prod",
+			serviceLabel: "api",
+			versionLabel: "1.2.3",
+		},
+		expected: []corev1.EnvVar{
+			hostIPEnvVar,
+			labelEnvVar("DD_ENV", envLabel),
+			labelEnvVar("DD_SERVICE", serviceLabel),
+			labelEnvVar("DD_VERSION", versionLabel),
+		},
+	}, {
+		name: "knative labels",
+		labels: map[string]string{
+			knativeServiceLabel:  "api",
+			knativeRevisionLabel: "api-00001",
+		},
+		expected: []corev1.EnvVar{
+			hostIPEnvVar,
+			labelEnvVar("DD_SERVICE", knativeServiceLabel),
+			labelEnvVar("DD_VERSION", knativeRevisionLabel),
+		},
+	}, {
+		name: "datadog labels take precedence over knative labels",
+		labels: map[string]string{
+			serviceLabel:         "api",
+			knativeServiceLabel:  "api-ksvc",
+			knativeRevisionLabel: "api-00001",
+		},
+		expected: []corev1.EnvVar{
+			hostIPEnvVar,
+			labelEnvVar("DD_SERVICE", serviceLabel),
+			labelEnvVar("DD_VERSION", knativeRevisionLabel),
+		},
+	}, {
+		name:   "user values are kept",
+		labels: map[string]string{envLabel: "prod", serviceLabel: "api"},
+		env:    []corev1.EnvVar{{Name: "DD_ENV", Value: "staging"}},
+		expected: []corev1.EnvVar{
+			{Name: "DD_ENV", Value: "staging"},
+			hostIPEnvVar,
+			labelEnvVar("DD_SERVICE", serviceLabel),
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := newAnnotatedPod(nil)
+			pod.Labels = test.labels
+			pod.Spec.Containers[0].Env = test.env
+			mutated := mutateAndApply(t, newTestPipeline(t), pod)
+			if !reflect.DeepEqual(mutated.Spec.Containers[0].Env, test.expected) {
+				t.Errorf("Unexpected env: got %v, want %v", mutated.Spec.Containers[0].Env, test.expected)
+			}
+		})
+	}
+}
+
+func TestMutateProfiles(t *testing.T) {
+	originDetection := []corev1.EnvVar{
+		hostIPEnvVar,
+		fieldRefEnvVar("DD_ENTITY_ID", "metadata.uid"),
+		fieldRefEnvVar("POD_NAME", "metadata.name"),
+		fieldRefEnvVar("POD_NAMESPACE", "metadata.namespace"),
+		fieldRefEnvVar("NODE_NAME", "spec.nodeName"),
+	}
+
+	tests := []struct {
+		name            string
+		namespace       *corev1.Namespace
+		podAnnotations  map[string]string
+		defaultProfiles []string
+		expected        []corev1.EnvVar
+	}{{
+		name:     "no profile",
+		expected: []corev1.EnvVar{hostIPEnvVar},
+	}, {
+		name:           "pod annotation",
+		podAnnotations: map[string]string{ProfilesAnnotation: "origin-detection"},
+		expected:       originDetection,
+	}, {
+		name:      "namespace annotation",
+		namespace: newAnnotatedNamespace(map[string]string{ProfilesAnnotation: " origin-detection, "}),
+		expected:  originDetection,
+	}, {
+		name:            "default profiles",
+		defaultProfiles: []string{"origin-detection"},
+		expected:        originDetection,
+	}, {
+		name:            "profiles disabled by the pod",
+		podAnnotations:  map[string]string{ProfilesAnnotation: ""},
+		defaultProfiles: []string{"origin-detection"},
+		expected:        []corev1.EnvVar{hostIPEnvVar},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var namespaces []*corev1.Namespace
+			if test.namespace != nil {
+				namespaces = append(namespaces, test.namespace)
+			}
+			p := newConfiguredPipeline(t, &Config{}, test.defaultProfiles, namespaces...)
+			mutated := mutateAndApply(t, p, newAnnotatedPod(test.podAnnotations))
+			if !reflect.DeepEqual(mutated.Spec.Containers[0].Env, test.expected) {
+				t.Errorf("Unexpected env: got %v, want %v", mutated.Spec.Containers[0].Env, test.expected)
+			}
+		})
+	}
+}
+
+func TestMutateOpenTelemetryProfile(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{ProfilesAnnotation: "opentelemetry"})
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "FOO", Value: "bar"},
+		{Name: "POD_NAME", Value: "overridden"},
+	}
+	mutated := mutateAndApply(t, newTestPipeline(t), pod)
+
+	env := mutated.Spec.Containers[0].Env
+	position := make(map[string]int, len(env))
+	for i, envVar := range env {
+		position[envVar.Name] = i
+	}
+	for _, envVar := range env {
+		for _, reference := range envVarReferences(envVar.Value) {
+			j, ok := position[reference]
+			if !ok {
+				t.Errorf("%q references %q which is not defined", envVar.Name, reference)
+			} else if j > position[envVar.Name] {
+				t.Errorf("%q references %q which is defined after it", envVar.Name, reference)
+			}
+		}
+	}
+	if env[1].Value != "overridden" {
+		t.Errorf("The user value of POD_NAME should be kept: %v", env[1])
+	}
+	if len(env) != 9 {
+		t.Errorf("Unexpected env: %v", env)
+	}
+}
+
+func TestMutateUnknownProfile(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{ProfilesAnnotation: "origin-detection,unknown"})
+	if _, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, pod)); !IsDenied(err) {
+		t.Fatalf("An unknown profile should be rejected, got: %v", err)
+	}
+}
+
+func TestMutateWorkloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     metav1.GroupVersionKind
+		raw      string
+		template []string
+	}{{
+		name:     "deployment",
+		kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		raw:      `{"metadata": {"name": "d"}, "spec": {"template": {"metadata": {"labels": {"app": "d"}, "annotations": {"foo": "bar"}}, "spec": {"containers": [{"name": "c"}]}}}}`,
+		template: []string{"spec", "template"},
+	}, {
+		name:     "statefulset without annotations",
+		kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+		raw:      `{"metadata": {"name": "s"}, "spec": {"template": {"metadata": {"labels": {"app": "s"}}, "spec": {"containers": [{"name": "c"}]}}}}`,
+		template: []string{"spec", "template"},
+	}, {
+		name:     "job without metadata",
+		kind:     metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+		raw:      `{"metadata": {"name": "j"}, "spec": {"template": {"spec": {"containers": [{"name": "c"}]}}}}`,
+		template: []string{"spec", "template"},
+	}, {
+		name:     "cronjob",
+		kind:     metav1.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"},
+		raw:      `{"metadata": {"name": "c"}, "spec": {"jobTemplate": {"spec": {"template": {"spec": {"containers": [{"name": "c"}]}}}}}}`,
+		template: []string{"spec", "jobTemplate", "spec", "template"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &admiv1beta1.AdmissionRequest{
+				UID:       "uid",
+				Kind:      test.kind,
+				Operation: admiv1beta1.Update,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: []byte(test.raw)},
+			}
+			resp, err := newTestPipeline(t).Mutate(req)
+			if err != nil {
+				t.Fatalf("Failed to mutate: %v", err)
+			}
+			mutated, err := extractJSON(applyJSONPatch(t, req.Object.Raw, resp.Patch), "/"+strings.Join(test.template, "/"))
+			if err != nil {
+				t.Fatalf("Failed to find the template: %v", err)
+			}
+			var template corev1.PodTemplateSpec
+			if err := json.Unmarshal(mutated, &template); err != nil {
+				t.Fatalf("Failed to decode the template: %v", err)
+			}
+			if !reflect.DeepEqual(template.Spec.Containers[0].Env, []corev1.EnvVar{hostIPEnvVar}) {
+				t.Errorf("Unexpected env: %v", template.Spec.Containers[0].Env)
+			}
+			if template.Annotations[injectedAnnotation] != "true" {
+				t.Errorf("The template should be marked as injected: %v", template.Annotations)
+			}
+
+			// Mutating the workload again is a no-op
+			req.Object.Raw = applyJSONPatch(t, req.Object.Raw, resp.Patch)
+			resp, err = newTestPipeline(t).Mutate(req)
+			if err != nil {
+				t.Fatalf("Failed to mutate: %v", err)
+			}
+			if resp.Patch != nil || resp.AuditAnnotations[warningsAuditAnnotation] != "" {
+				t.Errorf("Mutating an injected workload should be a no-op: %s %v", resp.Patch, resp.AuditAnnotations)
+			}
+		})
+	}
+}
+
+func TestMutateWorkloadAgain(t *testing.T) {
+	mutate := func(raw string) (*corev1.PodTemplateSpec, []byte, *admiv1beta1.AdmissionResponse) {
+		req := &admiv1beta1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Operation: admiv1beta1.Update,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: []byte(raw)},
+		}
+		resp, err := newConfiguredPipeline(t, &Config{AgentService: AgentServiceConfig{Name: "agent", Namespace: "datadog"}}, nil).Mutate(req)
+		if err != nil {
+			t.Fatalf("Failed to mutate: %v", err)
+		}
+		mutated := applyJSONPatch(t, req.Object.Raw, resp.Patch)
+		rawTemplate, err := extractJSON(mutated, "/spec/template")
+		if err != nil {
+			t.Fatalf("Failed to find the template: %v", err)
+		}
+		var template corev1.PodTemplateSpec
+		if err := json.Unmarshal(rawTemplate, &template); err != nil {
+			t.Fatalf("Failed to decode the template: %v", err)
+		}
+		return &template, mutated, resp
+	}
+
+	// The variables of the user are kept, whatever the mode
+	userEnvVar := corev1.EnvVar{Name: "DD_ENV", Value: "prod"}
+	template, mutated, _ := mutate(`{"metadata": {"name": "d"}, "spec": {"template": {
+  "metadata": {"labels": {"` + envLabel + `": "staging"}},
+  "spec": {"containers": [{"name": "c", "env": [{"name": "DD_ENV", "value": "prod"}]}]}}}}`)
+	if expected := []corev1.EnvVar{userEnvVar, hostIPEnvVar}; !reflect.DeepEqual(template.Spec.Containers[0].Env, expected) {
+		t.Fatalf("Unexpected env: got %v, want %v", template.Spec.Containers[0].Env, expected)
+	}
+
+	// Changing the mode of the workload replaces the variables injected in the previous mode
+	annotated := strings.Replace(string(mutated), `"annotations":{`, `"annotations":{"`+ModeAnnotation+`":"service",`, 1)
+	template, _, resp := mutate(annotated)
+	expected := []corev1.EnvVar{userEnvVar, {Name: AgentHostEnvVarName, Value: "agent.datadog.svc"}}
+	if !reflect.DeepEqual(template.Spec.Containers[0].Env, expected) {
+		t.Fatalf("The mode change should be applied: got %v, want %v", template.Spec.Containers[0].Env, expected)
+	}
+	// Only the variable defined by the user is reported
+	warnings := resp.AuditAnnotations[warningsAuditAnnotation]
+	if strings.Count(warnings, "keeping the original value") != 1 || !strings.Contains(warnings, `"DD_ENV"`) {
+		t.Fatalf("Unexpected warnings: %q", warnings)
+	}
+}
+
+func TestMutateKnative(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		expected []corev1.EnvVar
+	}{{
+		name: "service",
+		kind: "Service",
+		expected: []corev1.EnvVar{
+			hostIPEnvVar,
+			fieldRefEnvVar("DD_SERVICE", "metadata.labels['"+knativeServiceLabel+"']"),
+			fieldRefEnvVar("DD_VERSION", "metadata.labels['"+knativeRevisionLabel+"']"),
+		},
+	}, {
+		name: "configuration",
+		kind: "Configuration",
+		expected: []corev1.EnvVar{
+			hostIPEnvVar,
+			fieldRefEnvVar("DD_VERSION", "metadata.labels['"+knativeRevisionLabel+"']"),
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &admiv1beta1.AdmissionRequest{
+				UID:       "uid",
+				Kind:      metav1.GroupVersionKind{Group: "serving.knative.dev", Version: "v1", Kind: test.kind},
+				Operation: admiv1beta1.Create,
+				Namespace: "default",
+				Object: runtime.RawExtension{Raw: []byte(`{
+  "apiVersion": "serving.knative.dev/v1",
+  "kind": "` + test.kind + `",
+  "metadata": {"name": "hello"},
+  "spec": {"template": {"spec": {"containerConcurrency": 10, "containers": [{"image": "hello"}]}}}
+}`)},
+			}
+			resp, err := newTestPipeline(t).Mutate(req)
+			if err != nil {
+				t.Fatalf("Failed to mutate: %v", err)
+			}
+			mutated, err := extractJSON(applyJSONPatch(t, req.Object.Raw, resp.Patch), "/spec/template")
+			if err != nil {
+				t.Fatalf("Failed to find the template: %v", err)
+			}
+			var template struct {
+				corev1.PodTemplateSpec
+				Spec struct {
+					ContainerConcurrency int `json:"containerConcurrency"`
+					corev1.PodSpec
+				} `json:"spec"`
+			}
+			if err := json.Unmarshal(mutated, &template); err != nil {
+				t.Fatalf("Failed to decode the template: %v", err)
+			}
+			if template.Spec.ContainerConcurrency != 10 {
+				t.Errorf("The RevisionSpec fields should be preserved: %s", mutated)
+			}
+			if !reflect.DeepEqual(template.Spec.Containers[0].Env, test.expected) {
+				t.Errorf("Unexpected env: got %v, want %v", template.Spec.Containers[0].Env, test.expected)
+			}
+			if template.Annotations[injectedAnnotation] != "true" {
+				t.Errorf("The template should be marked as injected: %v", template.Annotations)
+			}
+		})
+	}
+}
+
+func TestMutateSkipsPodsOfInjectedTemplates(t *testing.T) {
+	controller := true
+	pod := newAnnotatedPod(map[string]string{injectedAnnotation: "true"})
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "api-7d9f8", UID: "1234", Controller: &controller}}
+	resp, err := newTestPipeline(t).Mutate(newAdmissionRequest(t, pod))
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+	if resp.Patch != nil {
+		t.Fatalf("The Pod should not be mutated: %s", resp.Patch)
+	}
+}
+
+func TestMutateIgnoresTheInjectedAnnotationOfBarePods(t *testing.T) {
+	pod := newAnnotatedPod(map[string]string{injectedAnnotation: "true"})
+	mutated := mutateAndApply(t, newTestPipeline(t), pod)
+	if !reflect.DeepEqual(mutated.Spec.Containers[0].Env, []corev1.EnvVar{hostIPEnvVar}) {
+		t.Fatalf("A Pod without controller should be mutated: %v", mutated.Spec.Containers[0].Env)
+	}
+}
+
+func TestMutateUnsupportedKind(t *testing.T) {
+	req := newAdmissionRequest(t, newAnnotatedPod(nil))
+	req.Kind = metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}
+	_, err := newTestPipeline(t).Mutate(req)
+	if err == nil {
+		t.Fatalf("An unsupported kind should be rejected")
+	}
+	if IsDenied(err) {
+		t.Fatalf("An unsupported kind is a failure of the Webhook rather than a denial: %v", err)
+	}
+}
+
+func BenchmarkMutate(b *testing.B) {
+	for _, containers := range []int{1, 10, 50} {
+		p := newTestPipeline(b)
+		req := newAdmissionRequest(b, newLargePod(containers))
+		b.Run(fmt.Sprintf("containers=%d", containers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Mutate(req); err != nil {
+					b.Fatalf("Failed to mutate: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMarshalAndDiff measures the previous approach, which re-marshaled
+// the mutated Pod and diffed it against the original, as a baseline for BenchmarkMutate.
+func BenchmarkMarshalAndDiff(b *testing.B) {
+	for _, containers := range []int{1, 10, 50} {
+		req := newAdmissionRequest(b, newLargePod(containers))
+		b.Run(fmt.Sprintf("containers=%d", containers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var pod corev1.Pod
+				if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+					b.Fatalf("Failed to decode: %v", err)
+				}
+				for j := range pod.Spec.Containers {
+					pod.Spec.Containers[j].Env = append(pod.Spec.Containers[j].Env, hostIPEnvVar)
+				}
+				bytes, err := json.Marshal(pod)
+				if err != nil {
+					b.Fatalf("Failed to encode: %v", err)
+				}
+				patch, err := gomodulesjsonpatch.CreatePatch(req.Object.Raw, bytes)
+				if err != nil {
+					b.Fatalf("Failed to diff: %v", err)
+				}
+				if _, err := json.Marshal(patch); err != nil {
+					b.Fatalf("Failed to encode the patch: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// newLargePod returns a Pod with the given number of containers, each with a realistic spec.
+func newLargePod(containers int) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Name = "large"
+	pod.Namespace = "default"
+	pod.Labels = map[string]string{"app": "large", "serving.knative.dev/service": "large"}
+	for i := 0; i < containers; i++ {
+		container := corev1.Container{
+			Name:    fmt.Sprintf("container-%d", i),
+			Image:   "gcr.io/project/image:latest",
+			Command: []string{"/bin/server", "--port", "8080"},
+			Ports:   []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+		}
+		for j := 0; j < 20; j++ {
+			container.Env = append(container.Env, corev1.EnvVar{
+				Name:  fmt.Sprintf("VAR_%d", j),
+				Value: fmt.Sprintf("value-%d", j),
+			})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+	}
+	return pod
+}
+
+func newAnnotatedNamespace(annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: annotations}}
+}
+
+func newAnnotatedPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Annotations: annotations},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "user-container"}, queueProxyContainer},
+		},
+	}
+}
+
+func newAdmissionRequest(tb testing.TB, pod *corev1.Pod) *admiv1beta1.AdmissionRequest {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		tb.Fatalf("Failed to encode the Pod: %v", err)
+	}
+	return &admiv1beta1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: admiv1beta1.Create,
+		Namespace: pod.Namespace,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+// newTestPipeline returns the Pipeline of the built-in Mutators in HostIPMode, aware of the provided Namespaces.
+func newTestPipeline(tb testing.TB, namespaces ...*corev1.Namespace) *Pipeline {
+	return newConfiguredPipeline(tb, &Config{}, nil, namespaces...)
+}
+
+// newConfiguredPipeline returns the Pipeline of the built-in Mutators configured by c.
+func newConfiguredPipeline(tb testing.TB, c *Config, defaultProfiles []string, namespaces ...*corev1.Namespace) *Pipeline {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		_ = indexer.Add(ns)
+	}
+	mutators, err := NewBuiltinMutators(c, corelisters.NewNamespaceLister(indexer), HostIPMode, defaultProfiles)
+	if err != nil {
+		tb.Fatalf("Failed to create the Mutators: %v", err)
+	}
+	return NewPipeline(mutators...)
+}
+
+// mutateAndApply mutates the Pod and returns the result of applying the returned patch to it.
+func mutateAndApply(t *testing.T, p *Pipeline, pod *corev1.Pod) *corev1.Pod {
+	req := newAdmissionRequest(t, pod)
+	resp, err := p.Mutate(req)
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+	if !resp.Allowed {
+		t.Fatalf("The Pod should be allowed: %v", resp.Result)
+	}
+	if resp.Patch == nil {
+		return pod
+	}
+	mutated := applyJSONPatch(t, req.Object.Raw, resp.Patch)
+	var result corev1.Pod
+	if err := json.Unmarshal(mutated, &result); err != nil {
+		t.Fatalf("Failed to decode the mutated Pod: %v", err)
+	}
+	return &result
+}
+
+func applyJSONPatch(t *testing.T, raw, patch []byte) []byte {
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		t.Fatalf("Failed to decode the patch %s: %v", patch, err)
+	}
+	mutated, err := decoded.Apply(raw)
+	if err != nil {
+		t.Fatalf("Failed to apply the patch %s: %v", patch, err)
+	}
+	return mutated
+}
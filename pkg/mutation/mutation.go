@@ -0,0 +1,85 @@
+// Package mutation computes the JSON patches mutating the admitted Pods, or the Pod templates of
+// the admitted workloads, through a Pipeline of Mutators.
+package mutation
+
+import (
+	"errors"
+	"fmt"
+
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+
+	"gomodules.xyz/jsonpatch/v3"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+)
+
+// SideEffects is the side effect class of the Pipeline of the built-in Mutators, declared by the
+// MutatingWebhookConfiguration. None of them has side effects.
+const SideEffects = admissionregistrationv1beta1.SideEffectClassNone
+
+// IsDryRun returns true if the changes of the admission request are not persisted, e.g. for
+// `kubectl apply --dry-run=server`.
+func IsDryRun(req *admiv1beta1.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// DeniedError rejects the admitted object because of the object itself, e.g. an invalid
+// annotation, as opposed to the failures of the Webhook.
+type DeniedError struct {
+	err error
+}
+
+func (e *DeniedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *DeniedError) Unwrap() error {
+	return e.err
+}
+
+// deny returns a DeniedError, the arguments are formatted like fmt.Errorf.
+func deny(format string, args ...interface{}) error {
+	return &DeniedError{err: fmt.Errorf(format, args...)}
+}
+
+// IsDenied returns true if err, or one of the errors it wraps, is a DeniedError.
+func IsDenied(err error) bool {
+	var denied *DeniedError
+	return errors.As(err, &denied)
+}
+
+// Request is the input of a Mutator.
+type Request struct {
+	// Admission is the admission request of the Pod or of the workload.
+	Admission *admiv1beta1.AdmissionRequest
+	// DryRun is true if the admitted object is not persisted. None of the built-in Mutators
+	// reads it since they have no side effects.
+	DryRun bool
+	// Template is the Pod template of the admitted object, including the mutations of the
+	// previous Mutators of the Pipeline.
+	Template *PodTemplate
+	// Log is the Logger of the admission request, whose lines identify it. When nil, e.g. in a
+	// Request built outside of the Pipeline, the lines are written to logging.Default().
+	Log *logging.Logger
+}
+
+// Result is the output of a Mutator.
+type Result struct {
+	// Patch are the operations against the admitted object, as mutated by the previous Mutators.
+	// The typed Template is only used to inspect the object: the operations target the raw JSON,
+	// so fields unknown to the vendored k8s.io/api types are left untouched.
+	Patch []jsonpatch.Operation
+	// Warnings describe what the Mutator couldn't do, they don't fail the admission.
+	Warnings []string
+	// AuditAnnotations are added to the audit event of the admission.
+	AuditAnnotations map[string]string
+}
+
+// Mutator is a step of the Pipeline.
+type Mutator interface {
+	// Name identifies the Mutator in the errors and warnings.
+	Name() string
+	// Mutate returns the mutation of the Pod template of the request, or nil if there is none.
+	Mutate(req *Request) (*Result, error)
+}
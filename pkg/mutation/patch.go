@@ -0,0 +1,96 @@
+package mutation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"gomodules.xyz/jsonpatch/v3"
+)
+
+// patchBuilder accumulates targeted JSON patch operations against the admitted object.
+// Unlike diffing the re-marshaled object, it never touches fields it doesn't explicitly add.
+type patchBuilder struct {
+	operations []jsonpatch.Operation
+}
+
+// add appends an "add" operation for the given JSON pointer.
+func (b *patchBuilder) add(path string, value interface{}) {
+	b.operations = append(b.operations, jsonpatch.NewOperation("add", path, value))
+}
+
+// addEnvVars inserts envVars in the environment of the container located at containerPath.
+// existing is the current environment of that container: if it is empty, the `env` array is
+// created, otherwise each variable is inserted at the position computed by insertEnvVars.
+func (b *patchBuilder) addEnvVars(containerPath string, existing []corev1.EnvVar, envVars []corev1.EnvVar) {
+	if len(envVars) == 0 {
+		return
+	}
+	if len(existing) == 0 {
+		// The array doesn't exist (or is empty): create it with all the values at once
+		b.add(containerPath+"/env", envVars)
+		return
+	}
+	for _, insertion := range insertEnvVars(existing, envVars) {
+		b.add(fmt.Sprintf("%s/env/%d", containerPath, insertion.index), insertion.envVar)
+	}
+}
+
+// addVolumeMount appends volumeMount to the container located at containerPath.
+// existing is the current list of volume mounts of that container.
+func (b *patchBuilder) addVolumeMount(containerPath string, existing []corev1.VolumeMount, volumeMount corev1.VolumeMount) {
+	if len(existing) == 0 {
+		b.add(containerPath+"/volumeMounts", []corev1.VolumeMount{volumeMount})
+		return
+	}
+	b.add(containerPath+"/volumeMounts/-", volumeMount)
+}
+
+// addVolume appends volume to the Pod spec located at specPath.
+// existing is the current list of volumes of that spec.
+func (b *patchBuilder) addVolume(specPath string, existing []corev1.Volume, volume corev1.Volume) {
+	if len(existing) == 0 {
+		b.add(specPath+"/volumes", []corev1.Volume{volume})
+		return
+	}
+	b.add(specPath+"/volumes/-", volume)
+}
+
+// addInitContainer appends container to the init containers of the Pod spec located at specPath.
+// existing is the current list of init containers of that spec.
+func (b *patchBuilder) addInitContainer(specPath string, existing []corev1.Container, container corev1.Container) {
+	if len(existing) == 0 {
+		b.add(specPath+"/initContainers", []corev1.Container{container})
+		return
+	}
+	b.add(specPath+"/initContainers/-", container)
+}
+
+// addAnnotations sets the annotations in the metadata located at metadataPath.
+// existing is the current annotations of that metadata, and hasMetadata is false if the metadata
+// itself is absent.
+func (b *patchBuilder) addAnnotations(metadataPath string, hasMetadata bool, existing map[string]string, annotations map[string]string) {
+	switch {
+	case len(annotations) == 0:
+	case !hasMetadata:
+		b.add(metadataPath, map[string]interface{}{"annotations": annotations})
+	case len(existing) == 0:
+		b.add(metadataPath+"/annotations", annotations)
+	default:
+		keys := make([]string, 0, len(annotations))
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.add(metadataPath+"/annotations/"+escapeJSONPointer(key), annotations[key])
+		}
+	}
+}
+
+// escapeJSONPointer escapes a JSON pointer reference token as defined by RFC 6901.
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,214 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	evanphxjsonpatch "github.com/evanphx/json-patch"
+	admiv1beta1 "k8s.io/api/admission/v1beta1"
+
+	"gomodules.xyz/jsonpatch/v3"
+
+	"github.com/JRBANCEL/MutatingAdmissionWebhook/pkg/logging"
+)
+
+// warningsAuditAnnotation records the warnings of the Mutators, since the AdmissionReview
+// v1beta1 can't return them to the user.
+const warningsAuditAnnotation = "warnings"
+
+// Pipeline runs an ordered list of Mutators.
+type Pipeline struct {
+	mutators []Mutator
+}
+
+// NewPipeline returns a Pipeline running the Mutators in order.
+func NewPipeline(mutators ...Mutator) *Pipeline {
+	return &Pipeline{mutators: mutators}
+}
+
+// Mutate runs the Mutators against the admitted object and returns the response carrying their
+// patches, concatenated in order. Each Mutator sees the object as mutated by the previous ones.
+// An operation of a Mutator overwriting a value added by another one is a conflict, which fails
+// the admission rather than silently dropping a mutation.
+func (p *Pipeline) Mutate(req *admiv1beta1.AdmissionRequest) (*admiv1beta1.AdmissionResponse, error) {
+	template, err := DecodePodTemplate(req.Kind, req.Object.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &admiv1beta1.AdmissionResponse{Allowed: true}
+
+	// The Pods created from a mutated workload template already contain everything
+	if template.IsPod() && template.isInjected() {
+		return resp, nil
+	}
+
+	dryRun := IsDryRun(req)
+	log := logging.ForAdmission(req)
+	raw := req.Object.Raw
+	var operations []jsonpatch.Operation
+	var warnings []string
+	var leaves map[string]string
+	owners := make(map[string]string)
+	auditAnnotations := make(map[string]string)
+	for _, m := range p.mutators {
+		result, err := m.Mutate(&Request{Admission: req, DryRun: dryRun, Template: template, Log: log.With("mutator", m.Name())})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Name(), err)
+		}
+		if result == nil {
+			continue
+		}
+
+		for _, warning := range result.Warnings {
+			warnings = append(warnings, m.Name()+": "+warning)
+		}
+		for key, value := range result.AuditAnnotations {
+			if existing, ok := auditAnnotations[key]; ok && existing != value {
+				return nil, fmt.Errorf("%s: conflicting value for the audit annotation %q", m.Name(), key)
+			}
+			auditAnnotations[key] = value
+		}
+
+		if len(result.Patch) == 0 {
+			continue
+		}
+		if leaves == nil {
+			if leaves, err = flattenJSON(raw); err != nil {
+				return nil, fmt.Errorf("failed to decode the object: %w", err)
+			}
+		}
+		if raw, err = applyPatch(raw, result.Patch); err != nil {
+			return nil, fmt.Errorf("%s: failed to apply the JSON patch: %w", m.Name(), err)
+		}
+		mutatedLeaves, err := flattenJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to decode the mutated object: %w", m.Name(), err)
+		}
+		if err := checkConflicts(owners, m.Name(), leaves, mutatedLeaves); err != nil {
+			return nil, err
+		}
+		leaves = mutatedLeaves
+		if template, err = DecodePodTemplate(req.Kind, raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Name(), err)
+		}
+		operations = append(operations, result.Patch...)
+	}
+
+	if !template.IsPod() && template.Annotations[injectedAnnotation] != "true" {
+		var patch patchBuilder
+		patch.addAnnotations(template.MetadataPath(), template.HasMetadata, template.Annotations, map[string]string{injectedAnnotation: "true"})
+		operations = append(operations, patch.operations...)
+	}
+
+	if len(warnings) > 0 {
+		log.Warn("Mutated with warnings", "warnings", warnings)
+		auditAnnotations[warningsAuditAnnotation] = strings.Join(warnings, "; ")
+	}
+	if len(auditAnnotations) > 0 {
+		resp.AuditAnnotations = auditAnnotations
+	}
+
+	if len(operations) == 0 {
+		return resp, nil
+	}
+	resp.Patch, err = json.Marshal(operations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the JSON patch: %w", err)
+	}
+	patchType := admiv1beta1.PatchTypeJSONPatch
+	resp.PatchType = &patchType
+	return resp, nil
+}
+
+// checkConflicts returns an error if the Mutator named name modified or removed a value set by
+// another Mutator, given the leaves of the object before and after its patch. Adding a value, e.g.
+// an element to an array or a key to an object added by another Mutator, is not a conflict. owners
+// maps the leaves set so far to their Mutator, it is updated with the modifications.
+func checkConflicts(owners map[string]string, name string, before, after map[string]string) error {
+	var modified []string
+	for path, value := range before {
+		if mutated, ok := after[path]; !ok || mutated != value {
+			modified = append(modified, path)
+		}
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			modified = append(modified, path)
+		}
+	}
+	// The paths are sorted for the error to be deterministic
+	sort.Strings(modified)
+	for _, path := range modified {
+		if owner, ok := owners[path]; ok && owner != name {
+			return fmt.Errorf("%s: the mutation of %q conflicts with the one of %s", name, path, owner)
+		}
+	}
+	for _, path := range modified {
+		if _, ok := after[path]; ok {
+			owners[path] = name
+		} else {
+			delete(owners, path)
+		}
+	}
+	return nil
+}
+
+// flattenJSON returns the leaves of the raw JSON document, by path. The elements
+// of the arrays are identified by their name, if any, rather than by their index, so that the path
+// of a leaf doesn't change when an element is inserted before it, e.g. /spec/containers[app]/env[HOST]/value.
+func flattenJSON(raw []byte) (map[string]string, error) {
+	var document interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+	leaves := make(map[string]string)
+	flattenValue(leaves, "", document)
+	return leaves, nil
+}
+
+func flattenValue(leaves map[string]string, path string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenValue(leaves, path+"/"+escapeJSONPointer(key), child)
+		}
+	case []interface{}:
+		// Duplicated names, e.g. of environment variables, are told apart by their occurrence
+		occurrences := make(map[string]int)
+		for i, child := range v {
+			element := "/" + strconv.Itoa(i)
+			if object, ok := child.(map[string]interface{}); ok {
+				if name, ok := object["name"].(string); ok {
+					element = "[" + name + "]"
+					if n := occurrences[name]; n > 0 {
+						element += "#" + strconv.Itoa(n)
+					}
+					occurrences[name]++
+				}
+			}
+			flattenValue(leaves, path+element, child)
+		}
+	case string:
+		// Quoted to be told apart from the other types
+		leaves[path] = strconv.Quote(v)
+	default:
+		leaves[path] = fmt.Sprint(v)
+	}
+}
+
+// applyPatch returns raw once the operations are applied.
+func applyPatch(raw []byte, operations []jsonpatch.Operation) ([]byte, error) {
+	encoded, err := json.Marshal(operations)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := evanphxjsonpatch.DecodePatch(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return patch.Apply(raw)
+}
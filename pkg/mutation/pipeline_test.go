@@ -0,0 +1,228 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"gomodules.xyz/jsonpatch/v3"
+)
+
+// fakeMutator returns a fixed Result, or the Result computed by mutate if set.
+type fakeMutator struct {
+	name   string
+	result *Result
+	mutate func(req *Request) *Result
+}
+
+func (m *fakeMutator) Name() string {
+	return m.name
+}
+
+func (m *fakeMutator) Mutate(req *Request) (*Result, error) {
+	if m.mutate != nil {
+		return m.mutate(req), nil
+	}
+	return m.result, nil
+}
+
+func addLabel(key, value string) jsonpatch.Operation {
+	return jsonpatch.NewOperation("add", "/metadata/labels", map[string]string{key: value})
+}
+
+func TestPipelineRunsMutatorsInOrder(t *testing.T) {
+	first := &fakeMutator{name: "first", result: &Result{
+		Patch: []jsonpatch.Operation{addLabel("a", "b")},
+	}}
+	second := &fakeMutator{name: "second", mutate: func(req *Request) *Result {
+		// The second Mutator sees the label added by the first one
+		if req.Template.Labels["a"] != "b" {
+			t.Errorf("The mutation of the previous Mutator is not visible: %v", req.Template.Labels)
+		}
+		return &Result{Patch: []jsonpatch.Operation{
+			jsonpatch.NewOperation("add", "/metadata/labels/c", "d"),
+			jsonpatch.NewOperation("add", "/spec/containers/0/env", []corev1.EnvVar{{Name: "FOO", Value: "bar"}}),
+		}}
+	}}
+
+	pod := newAnnotatedPod(nil)
+	p := NewPipeline(first, second)
+	mutated := mutateAndApply(t, p, pod)
+	if expected := map[string]string{"a": "b", "c": "d"}; !reflect.DeepEqual(mutated.Labels, expected) {
+		t.Errorf("Unexpected labels: got %v, want %v", mutated.Labels, expected)
+	}
+	if expected := []corev1.EnvVar{{Name: "FOO", Value: "bar"}}; !reflect.DeepEqual(mutated.Spec.Containers[0].Env, expected) {
+		t.Errorf("Unexpected env: got %v, want %v", mutated.Spec.Containers[0].Env, expected)
+	}
+}
+
+func TestPipelineConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation jsonpatch.Operation
+		conflicts bool
+	}{{
+		name:      "overwrite",
+		operation: addLabel("c", "d"),
+		conflicts: true,
+	}, {
+		name:      "replace of a child",
+		operation: jsonpatch.NewOperation("replace", "/metadata/labels/a", "c"),
+		conflicts: true,
+	}, {
+		name:      "remove of a parent",
+		operation: jsonpatch.NewOperation("remove", "/metadata", nil),
+		conflicts: true,
+	}, {
+		name:      "add of a child",
+		operation: jsonpatch.NewOperation("add", "/metadata/labels/c", "d"),
+	}, {
+		name:      "array insertion",
+		operation: jsonpatch.NewOperation("add", "/spec/containers/-", corev1.Container{Name: "sidecar"}),
+	}, {
+		name:      "unrelated path",
+		operation: jsonpatch.NewOperation("add", "/metadata/annotations", map[string]string{"c": "d"}),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewPipeline(
+				&fakeMutator{name: "first", result: &Result{Patch: []jsonpatch.Operation{addLabel("a", "b")}}},
+				&fakeMutator{name: "second", result: &Result{Patch: []jsonpatch.Operation{test.operation}}},
+			)
+			_, err := p.Mutate(newAdmissionRequest(t, newAnnotatedPod(nil)))
+			if test.conflicts && err == nil {
+				t.Fatalf("The conflicting operation should be rejected")
+			}
+			if !test.conflicts && err != nil {
+				t.Fatalf("Unexpected conflict: %v", err)
+			}
+		})
+	}
+}
+
+func TestPipelineConflictsAfterArrayInsertions(t *testing.T) {
+	addEnvVar := func(index int, name string) jsonpatch.Operation {
+		return jsonpatch.NewOperation("add", fmt.Sprintf("/spec/containers/0/env/%d", index), corev1.EnvVar{Name: name, Value: "v"})
+	}
+
+	tests := []struct {
+		name      string
+		operation jsonpatch.Operation
+		conflicts bool
+	}{{
+		// The variable of the first Mutator was shifted to index 1 by the insertion of the second one
+		name:      "remove of a shifted variable",
+		operation: jsonpatch.NewOperation("remove", "/spec/containers/0/env/1", nil),
+		conflicts: true,
+	}, {
+		name:      "add overwriting the value of a shifted variable",
+		operation: jsonpatch.NewOperation("add", "/spec/containers/0/env/1/value", "overwritten"),
+		conflicts: true,
+	}, {
+		name:      "add of a missing field of a shifted variable",
+		operation: jsonpatch.NewOperation("add", "/spec/containers/0/env/1/valueFrom", &corev1.EnvVarSource{}),
+	}, {
+		name:      "remove of a variable of the user",
+		operation: jsonpatch.NewOperation("remove", "/spec/containers/0/env/2", nil),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := newAnnotatedPod(nil)
+			pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "USER", Value: "v"}}
+			p := NewPipeline(
+				&fakeMutator{name: "first", result: &Result{Patch: []jsonpatch.Operation{addEnvVar(0, "FIRST")}}},
+				&fakeMutator{name: "second", result: &Result{Patch: []jsonpatch.Operation{addEnvVar(0, "SECOND")}}},
+				&fakeMutator{name: "third", result: &Result{Patch: []jsonpatch.Operation{test.operation}}},
+			)
+			_, err := p.Mutate(newAdmissionRequest(t, pod))
+			if test.conflicts && err == nil {
+				t.Fatalf("The conflicting operation should be rejected")
+			}
+			if !test.conflicts && err != nil {
+				t.Fatalf("Unexpected conflict: %v", err)
+			}
+		})
+	}
+}
+
+func TestPipelineMergesWarningsAndAuditAnnotations(t *testing.T) {
+	p := NewPipeline(
+		&fakeMutator{name: "first", result: &Result{
+			Warnings:         []string{"something is off"},
+			AuditAnnotations: map[string]string{"a": "b"},
+		}},
+		&fakeMutator{name: "second", result: &Result{
+			Warnings:         []string{"something else is off"},
+			AuditAnnotations: map[string]string{"a": "b", "c": "d"},
+		}},
+	)
+	resp, err := p.Mutate(newAdmissionRequest(t, newAnnotatedPod(nil)))
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+	expected := map[string]string{
+		"a":                     "b",
+		"c":                     "d",
+		warningsAuditAnnotation: "first: something is off; second: something else is off",
+	}
+	if !reflect.DeepEqual(resp.AuditAnnotations, expected) {
+		t.Fatalf("Unexpected audit annotations: got %v, want %v", resp.AuditAnnotations, expected)
+	}
+	if resp.Patch != nil {
+		t.Fatalf("No patch should be returned: %s", resp.Patch)
+	}
+}
+
+func TestPipelineConflictingAuditAnnotations(t *testing.T) {
+	p := NewPipeline(
+		&fakeMutator{name: "first", result: &Result{AuditAnnotations: map[string]string{"a": "b"}}},
+		&fakeMutator{name: "second", result: &Result{AuditAnnotations: map[string]string{"a": "c"}}},
+	)
+	if _, err := p.Mutate(newAdmissionRequest(t, newAnnotatedPod(nil))); err == nil {
+		t.Fatalf("Conflicting audit annotations should be rejected")
+	}
+}
+
+func TestPipelineConcatenatesPatches(t *testing.T) {
+	p := NewPipeline(
+		&fakeMutator{name: "first", result: &Result{Patch: []jsonpatch.Operation{addLabel("a", "b")}}},
+		&fakeMutator{name: "second"},
+		&fakeMutator{name: "third", result: &Result{Patch: []jsonpatch.Operation{
+			jsonpatch.NewOperation("add", "/metadata/labels/c", "d"),
+		}}},
+	)
+	resp, err := p.Mutate(newAdmissionRequest(t, newAnnotatedPod(nil)))
+	if err != nil {
+		t.Fatalf("Failed to mutate: %v", err)
+	}
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(resp.Patch, &operations); err != nil {
+		t.Fatalf("Failed to decode the patch: %v", err)
+	}
+	if len(operations) != 2 || operations[0]["path"] != "/metadata/labels" || operations[1]["path"] != "/metadata/labels/c" {
+		t.Fatalf("The patches should be concatenated in order: %s", resp.Patch)
+	}
+}
+
+func TestPipelineDryRun(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		var seen []bool
+		m := &fakeMutator{name: "fake", mutate: func(req *Request) *Result {
+			seen = append(seen, req.DryRun)
+			return nil
+		}}
+		req := newAdmissionRequest(t, newAnnotatedPod(nil))
+		req.DryRun = &dryRun
+		if _, err := NewPipeline(m, m).Mutate(req); err != nil {
+			t.Fatalf("Failed to mutate: %v", err)
+		}
+		if !reflect.DeepEqual(seen, []bool{dryRun, dryRun}) {
+			t.Errorf("The Mutators should see the dry run %t: %v", dryRun, seen)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package mutation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ProfilesAnnotation selects the comma-separated list of profiles injected in a Pod.
+// It can be set on the Pod or on its Namespace.
+const ProfilesAnnotation = "node-ip-webhook/profiles"
+
+// profiles are named sets of environment variables injected on top of the ones of the injection mode.
+var profiles = map[string][]corev1.EnvVar{
+	// origin-detection exposes the identity of the Pod, used by DogStatsD origin detection
+	// and to tag the metrics with the Pod, Namespace and Node names.
+	"origin-detection": {
+		fieldRefEnvVar("DD_ENTITY_ID", "metadata.uid"),
+		fieldRefEnvVar("POD_NAME", "metadata.name"),
+		fieldRefEnvVar("POD_NAMESPACE", "metadata.namespace"),
+		fieldRefEnvVar("NODE_NAME", "spec.nodeName"),
+	},
+	// opentelemetry points the OpenTelemetry SDKs at the collector running on the Node
+	// and describes the Pod with the Kubernetes resource semantic conventions.
+	"opentelemetry": {
+		fieldRefEnvVar("HOST_IP", "status.hostIP"),
+		fieldRefEnvVar("POD_NAME", "metadata.name"),
+		fieldRefEnvVar("POD_NAMESPACE", "metadata.namespace"),
+		fieldRefEnvVar("POD_UID", "metadata.uid"),
+		fieldRefEnvVar("NODE_NAME", "spec.nodeName"),
+		{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Value: "http://$(HOST_IP):4317"},
+		{Name: "OTEL_RESOURCE_ATTRIBUTES", Value: "k8s.pod.name=$(POD_NAME),k8s.namespace.name=$(POD_NAMESPACE),k8s.pod.uid=$(POD_UID),k8s.node.name=$(NODE_NAME)"},
+	},
+}
+
+// ParseProfiles returns the profile names contained in the comma-separated list s.
+func ParseProfiles(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := profiles[name]; !ok {
+			return nil, fmt.Errorf("unknown profile %q, must be one of %v", name, profileNames())
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// profileNames returns the sorted names of the known profiles.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldRefEnvVar returns an environment variable exposing fieldPath via the Downward API.
+func fieldRefEnvVar(name, fieldPath string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{
+				FieldPath: fieldPath,
+			},
+		},
+	}
+}
+
+// mergeEnvVars concatenates the lists of environment variables, the first definition of a name wins.
+func mergeEnvVars(lists ...[]corev1.EnvVar) []corev1.EnvVar {
+	var merged []corev1.EnvVar
+	for _, envVars := range lists {
+		for _, envVar := range envVars {
+			if !hasEnvVar(merged, envVar.Name) {
+				merged = append(merged, envVar)
+			}
+		}
+	}
+	return merged
+}
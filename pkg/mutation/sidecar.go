@@ -0,0 +1,112 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// istioStatusAnnotation is set by the Istio injector, it lists the containers it injected.
+	istioStatusAnnotation = "sidecar.istio.io/status"
+	// linkerdProxyVersionAnnotation is set by the Linkerd injector when it injects its proxy.
+	linkerdProxyVersionAnnotation = "linkerd.io/proxy-version"
+
+	// skippedContainersAuditAnnotation records the containers skipped along with the reason.
+	skippedContainersAuditAnnotation = "skipped-containers"
+)
+
+// wellKnownSidecarImages matches the images of the well-known sidecars.
+var wellKnownSidecarImages = []struct {
+	pattern *regexp.Regexp
+	reason  string
+}{
+	{pattern: regexp.MustCompile(`knative\.dev/serving/cmd/queue([:@]|$)`), reason: "Knative queue-proxy image"},
+	{pattern: regexp.MustCompile(`(^|/)istio/proxyv2([:@]|$)`), reason: "Istio proxy image"},
+	{pattern: regexp.MustCompile(`(^|/)linkerd/proxy([:@]|$)`), reason: "Linkerd proxy image"},
+}
+
+// sidecarDetector identifies the containers that must not be mutated because they are sidecars
+// rather than application containers.
+type sidecarDetector struct {
+	names  map[string]bool
+	images []*regexp.Regexp
+}
+
+// newSidecarDetector returns a sidecarDetector recognizing the well-known sidecars in addition to
+// the configured ones.
+func newSidecarDetector(c SidecarConfig) (*sidecarDetector, error) {
+	d := &sidecarDetector{names: make(map[string]bool, len(c.Names))}
+	for _, name := range c.Names {
+		d.names[name] = true
+	}
+	for _, image := range c.Images {
+		pattern, err := regexp.Compile(image)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q: %w", image, err)
+		}
+		d.images = append(d.images, pattern)
+	}
+	return d, nil
+}
+
+// detect returns the reason why the container of the template is a sidecar, "" if it isn't one.
+func (d *sidecarDetector) detect(template *PodTemplate, container corev1.Container) string {
+	if d.names[container.Name] {
+		return "configured name"
+	}
+	for _, pattern := range d.images {
+		if pattern.MatchString(container.Image) {
+			return fmt.Sprintf("configured image pattern %q", pattern.String())
+		}
+	}
+
+	// The injectors annotate the Pods they mutate
+	if status, ok := template.Annotations[istioStatusAnnotation]; ok {
+		var injected struct {
+			Containers []string `json:"containers"`
+		}
+		if err := json.Unmarshal([]byte(status), &injected); err == nil {
+			for _, name := range injected.Containers {
+				if name == container.Name {
+					return "injected by Istio"
+				}
+			}
+		}
+	}
+	if _, ok := template.Annotations[linkerdProxyVersionAnnotation]; ok && container.Name == "linkerd-proxy" {
+		return "injected by Linkerd"
+	}
+	if _, ok := template.Labels[knativeRevisionLabel]; ok && container.Name == "queue-proxy" {
+		return "injected by Knative"
+	}
+	if container.Name == agentSidecarContainerName {
+		return "Datadog Agent sidecar"
+	}
+
+	for _, image := range wellKnownSidecarImages {
+		if image.pattern.MatchString(container.Image) {
+			return image.reason
+		}
+	}
+	return ""
+}
+
+// formatSkippedContainers formats the reason why each container was skipped as an audit annotation value.
+func formatSkippedContainers(skipped map[string]string) string {
+	names := make([]string, 0, len(skipped))
+	for name := range skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, name+": "+skipped[name])
+	}
+	return strings.Join(entries, "; ")
+}
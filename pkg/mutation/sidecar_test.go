@@ -0,0 +1,88 @@
+package mutation
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSidecarDetector(t *testing.T) {
+	d, err := newSidecarDetector(SidecarConfig{
+		Names:  []string{"vault-agent"},
+		Images: []string{`^example\.com/sidecars/`},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the detector: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		container   corev1.Container
+		sidecar     bool
+	}{{
+		name:      "application container",
+		container: corev1.Container{Name: "app", Image: "example.com/app:1.0"},
+	}, {
+		name:      "user container named queue-proxy",
+		container: corev1.Container{Name: "queue-proxy", Image: "example.com/app:1.0"},
+	}, {
+		name:      "knative queue-proxy",
+		labels:    map[string]string{knativeRevisionLabel: "hello-00001"},
+		container: corev1.Container{Name: "queue-proxy", Image: "registry.local/queue:1.0"},
+		sidecar:   true,
+	}, {
+		name:      "knative queue-proxy image",
+		container: corev1.Container{Name: "proxy", Image: "gcr.io/knative-releases/knative.dev/serving/cmd/queue:v0.20.0"},
+		sidecar:   true,
+	}, {
+		name:        "istio injected container",
+		annotations: map[string]string{istioStatusAnnotation: `{"initContainers":["istio-init"],"containers":["istio-proxy"]}`},
+		container:   corev1.Container{Name: "istio-proxy", Image: "registry.local/proxy:1.0"},
+		sidecar:     true,
+	}, {
+		name:        "istio status listing other containers",
+		annotations: map[string]string{istioStatusAnnotation: `{"containers":["istio-proxy"]}`},
+		container:   corev1.Container{Name: "app", Image: "example.com/app:1.0"},
+	}, {
+		name:      "istio proxy image",
+		container: corev1.Container{Name: "istio-proxy", Image: "docker.io/istio/proxyv2:1.8.0"},
+		sidecar:   true,
+	}, {
+		name:        "linkerd injected container",
+		annotations: map[string]string{linkerdProxyVersionAnnotation: "stable-2.9.0"},
+		container:   corev1.Container{Name: "linkerd-proxy", Image: "registry.local/proxy:1.0"},
+		sidecar:     true,
+	}, {
+		name:      "linkerd proxy image",
+		container: corev1.Container{Name: "proxy", Image: "ghcr.io/linkerd/proxy:stable-2.9.0"},
+		sidecar:   true,
+	}, {
+		name:      "configured name",
+		container: corev1.Container{Name: "vault-agent", Image: "vault:1.6"},
+		sidecar:   true,
+	}, {
+		name:      "configured image",
+		container: corev1.Container{Name: "logger", Image: "example.com/sidecars/logger:1.0"},
+		sidecar:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template := &PodTemplate{}
+			template.ObjectMeta = metav1.ObjectMeta{Labels: test.labels, Annotations: test.annotations}
+			reason := d.detect(template, test.container)
+			if (reason != "") != test.sidecar {
+				t.Fatalf("Unexpected detection of %v: %q", test.container, reason)
+			}
+		})
+	}
+}
+
+func TestInvalidSidecarImagePattern(t *testing.T) {
+	if _, err := newSidecarDetector(SidecarConfig{Images: []string{"("}}); err == nil {
+		t.Fatalf("An invalid image pattern should be rejected")
+	}
+}
@@ -0,0 +1,64 @@
+package mutation
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Labels of the Datadog unified service tagging.
+	// See https://docs.datadoghq.com/getting_started/tagging/unified_service_tagging/
+	envLabel     = "tags.datadoghq.com/env"
+	serviceLabel = "tags.datadoghq.com/service"
+	versionLabel = "tags.datadoghq.com/version"
+
+	// Labels set by Knative on the Pods it creates.
+	knativeServiceLabel  = "serving.knative.dev/service"
+	knativeRevisionLabel = "serving.knative.dev/revision"
+)
+
+// unifiedServiceTags lists the unified service tagging environment variables along with
+// the Pod labels their value can be read from, by order of preference.
+var unifiedServiceTags = []struct {
+	envVarName string
+	labels     []string
+}{
+	{envVarName: "DD_ENV", labels: []string{envLabel}},
+	{envVarName: "DD_SERVICE", labels: []string{serviceLabel, knativeServiceLabel}},
+	{envVarName: "DD_VERSION", labels: []string{versionLabel, knativeRevisionLabel}},
+}
+
+// unifiedServiceTagEnvVars returns the environment variables exposing the unified service
+// tags of a Pod with the provided labels. The values are read at runtime via the Downward API,
+// a variable is only returned if one of its labels is set.
+func unifiedServiceTagEnvVars(labels map[string]string) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	for _, tag := range unifiedServiceTags {
+		for _, label := range tag.labels {
+			if _, ok := labels[label]; !ok {
+				continue
+			}
+			envVars = append(envVars, fieldRefEnvVar(tag.envVarName, "metadata.labels['"+label+"']"))
+			break
+		}
+	}
+	return envVars
+}
+
+// MissingUnifiedServiceTagLabels returns, for each unified service tag without any of its labels
+// in labels, its preferred label.
+func MissingUnifiedServiceTagLabels(labels map[string]string) []string {
+	var missing []string
+	for _, tag := range unifiedServiceTags {
+		found := false
+		for _, label := range tag.labels {
+			if _, ok := labels[label]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, tag.labels[0])
+		}
+	}
+	return missing
+}
@@ -0,0 +1,146 @@
+package mutation
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// injectedAnnotation marks a Pod template already mutated through its workload. It is propagated
+// to the Pods created from the template, which are then left untouched.
+//
+// The annotation is not a proof of the mutation: it is only honored on the Pods created by a
+// controller, so that it cannot be set on a bare Pod to bypass the injection. A workload whose
+// template carries it without having been mutated is trusted, its author could as well remove the
+// injected variables.
+const injectedAnnotation = "node-ip-webhook/injected"
+
+// podTemplateKind describes where the Pod template of a kind is located.
+type podTemplateKind struct {
+	// path is the JSON pointer of the Pod template in the objects of this kind.
+	path string
+	// podLabels are the labels added to the Pods, on top of the ones of the template,
+	// by the controllers of this kind.
+	podLabels []string
+}
+
+// podTemplateKinds are the supported kinds. The Pod itself is at the root of the object
+// since it has a `metadata` and a `spec` too.
+var podTemplateKinds = map[metav1.GroupKind]podTemplateKind{
+	{Group: "", Kind: "Pod"}:             {path: ""},
+	{Group: "apps", Kind: "Deployment"}:  {path: "/spec/template"},
+	{Group: "apps", Kind: "StatefulSet"}: {path: "/spec/template"},
+	{Group: "apps", Kind: "DaemonSet"}:   {path: "/spec/template"},
+	{Group: "batch", Kind: "Job"}:        {path: "/spec/template"},
+	{Group: "batch", Kind: "CronJob"}:    {path: "/spec/jobTemplate/spec/template"},
+	// The RevisionSpec of Knative embeds the PodSpec, its containers are where a Pod would have them.
+	{Group: "serving.knative.dev", Kind: "Service"}: {
+		path:      "/spec/template",
+		podLabels: []string{knativeServiceLabel, knativeRevisionLabel},
+	},
+	{Group: "serving.knative.dev", Kind: "Configuration"}: {
+		path:      "/spec/template",
+		podLabels: []string{knativeRevisionLabel},
+	},
+}
+
+// PodTemplate is the part of the admitted object describing the Pod(s) to mutate.
+type PodTemplate struct {
+	corev1.PodTemplateSpec
+
+	podTemplateKind
+
+	// HasMetadata is false if the `metadata` field of the template is absent.
+	HasMetadata bool
+}
+
+// DecodePodTemplate returns the Pod template of the raw object of kind gvk.
+func DecodePodTemplate(gvk metav1.GroupVersionKind, object []byte) (*PodTemplate, error) {
+	kind, ok := podTemplateKinds[metav1.GroupKind{Group: gvk.Group, Kind: gvk.Kind}]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %s", gvk.String())
+	}
+
+	raw, err := extractJSON(object, kind.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the Pod template %q: %w", kind.path, err)
+	}
+	template := &PodTemplate{podTemplateKind: kind}
+	if err := json.Unmarshal(raw, &template.PodTemplateSpec); err != nil {
+		return nil, fmt.Errorf("failed to decode the Pod template %q: %w", kind.path, err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("failed to decode the Pod template %q: %w", kind.path, err)
+	}
+	_, template.HasMetadata = fields["metadata"]
+	return template, nil
+}
+
+// isInjected returns true if the template is a Pod created by a controller from a mutated
+// template.
+func (t *PodTemplate) isInjected() bool {
+	return t.Annotations[injectedAnnotation] == "true" && metav1.GetControllerOf(&t.ObjectMeta) != nil
+}
+
+// IsPod returns true if the template is a Pod rather than the template of a workload.
+func (t *PodTemplate) IsPod() bool {
+	return t.path == ""
+}
+
+// ExpectedPodLabels returns the labels the Pods created from the template will have, with an empty
+// value for the ones only known once the Pods are created.
+func (t *PodTemplate) ExpectedPodLabels() map[string]string {
+	if len(t.podLabels) == 0 {
+		return t.Labels
+	}
+	labels := make(map[string]string, len(t.Labels)+len(t.podLabels))
+	for key, value := range t.Labels {
+		labels[key] = value
+	}
+	for _, key := range t.podLabels {
+		if _, ok := labels[key]; !ok {
+			labels[key] = ""
+		}
+	}
+	return labels
+}
+
+// MetadataPath returns the JSON pointer of the metadata of the template.
+func (t *PodTemplate) MetadataPath() string {
+	return t.path + "/metadata"
+}
+
+// SpecPath returns the JSON pointer of the spec of the template.
+func (t *PodTemplate) SpecPath() string {
+	return t.path + "/spec"
+}
+
+// ContainerPath returns the JSON pointer of the i-th container of the template.
+func (t *PodTemplate) ContainerPath(i int) string {
+	return t.SpecPath() + "/containers/" + strconv.Itoa(i)
+}
+
+// extractJSON returns the value located at the JSON pointer path of the raw JSON document.
+// Only objects are traversed, which is enough for the paths of podTemplateKinds.
+func extractJSON(raw []byte, path string) ([]byte, error) {
+	if path == "" {
+		return raw, nil
+	}
+	for _, token := range strings.Split(path, "/")[1:] {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, err
+		}
+		value, ok := object[token]
+		if !ok {
+			return nil, fmt.Errorf("field %q not found", token)
+		}
+		raw = value
+	}
+	return raw, nil
+}
@@ -0,0 +1,101 @@
+package mutation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxValueTemplateOutput bounds the size of the values rendered by the templates.
+const maxValueTemplateOutput = 4096
+
+// errValueTemplateOutputTooLarge is returned when a template renders more than maxValueTemplateOutput bytes.
+var errValueTemplateOutputTooLarge = fmt.Errorf("the output exceeds %d bytes", maxValueTemplateOutput)
+
+// templateData is what the value templates are executed against. It only exposes plain values of
+// the Pod, rather than the Pod itself, so that the templates can't call the methods of its types.
+type templateData struct {
+	// Name is the name of the Pod, empty for the templates of the workloads.
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	Container   struct {
+		Name  string
+		Image string
+	}
+}
+
+// newTemplateData returns the templateData of the container of the template.
+func newTemplateData(template *PodTemplate, namespace string, container corev1.Container) templateData {
+	data := templateData{
+		Name:        template.Name,
+		Namespace:   namespace,
+		Labels:      template.ExpectedPodLabels(),
+		Annotations: template.Annotations,
+	}
+	data.Container.Name = container.Name
+	data.Container.Image = container.Image
+	return data
+}
+
+// valueTemplateFuncs are the functions available to the templates on top of the builtin ones,
+// some of which are disabled.
+var valueTemplateFuncs = template.FuncMap{
+	// call would execute the functions found in the data, there are none but keep it that way
+	"call": func(interface{}, ...interface{}) (string, error) {
+		return "", errors.New("call is not allowed")
+	},
+	// default returns value, or fallback if value is empty: {{ .Labels.team | default "none" }}
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// valueTemplate is a Go template rendering a value from templateData. The labels and annotations
+// absent from the maps are rendered as empty strings.
+type valueTemplate struct {
+	template *template.Template
+}
+
+// parseValueTemplate parses text and checks it can be executed against templateData.
+func parseValueTemplate(name, text string) (*valueTemplate, error) {
+	t, err := template.New(name).Option("missingkey=zero").Funcs(valueTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	vt := &valueTemplate{template: t}
+	// Unknown fields are only detected at execution
+	if _, err := vt.execute(templateData{}); err != nil {
+		return nil, err
+	}
+	return vt, nil
+}
+
+// execute renders the template against data.
+func (t *valueTemplate) execute(data templateData) (string, error) {
+	w := &limitedBuffer{limit: maxValueTemplateOutput}
+	if err := t.template.Execute(w, data); err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
+
+// limitedBuffer is a bytes.Buffer failing the writes beyond limit bytes.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errValueTemplateOutputTooLarge
+	}
+	return b.Buffer.Write(p)
+}
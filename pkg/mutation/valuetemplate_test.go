@@ -0,0 +1,78 @@
+package mutation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValueTemplate(t *testing.T) {
+	data := templateData{
+		Name:      "web-1",
+		Namespace: "prod",
+		Labels:    map[string]string{"team": "edge"},
+	}
+	data.Container.Name = "nginx"
+
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+		valid    bool
+	}{{
+		name:     "fields",
+		text:     "team:{{.Labels.team}} ns:{{.Namespace}} container:{{.Container.Name}}",
+		expected: "team:edge ns:prod container:nginx",
+		valid:    true,
+	}, {
+		name:     "missing key",
+		text:     "owner:{{.Labels.owner}}",
+		expected: "owner:",
+		valid:    true,
+	}, {
+		name:     "default",
+		text:     `owner:{{.Labels.owner | default "none"}} team:{{.Labels.team | default "none"}}`,
+		expected: "owner:none team:edge",
+		valid:    true,
+	}, {
+		name: "unknown field",
+		text: "{{.Spec.NodeName}}",
+	}, {
+		name: "call",
+		text: "{{call .Name}}",
+	}, {
+		name: "syntax error",
+		text: "{{.Labels",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vt, err := parseValueTemplate(test.name, test.text)
+			if err == nil {
+				var value string
+				if value, err = vt.execute(data); err == nil && value != test.expected {
+					t.Fatalf("Unexpected value: got %q, want %q", value, test.expected)
+				}
+			}
+			if test.valid && err != nil {
+				t.Fatalf("Failed to render %q: %v", test.text, err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("%q should be rejected", test.text)
+			}
+		})
+	}
+}
+
+func TestValueTemplateOutputLimit(t *testing.T) {
+	vt, err := parseValueTemplate("large", `{{range .Labels}}{{.}}{{end}}`)
+	if err != nil {
+		t.Fatalf("Failed to parse the template: %v", err)
+	}
+	data := templateData{Labels: map[string]string{
+		"a": strings.Repeat("a", maxValueTemplateOutput/2),
+		"b": strings.Repeat("b", maxValueTemplateOutput/2+1),
+	}}
+	if _, err := vt.execute(data); err == nil {
+		t.Fatalf("An output larger than %d bytes should be rejected", maxValueTemplateOutput)
+	}
+}